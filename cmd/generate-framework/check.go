@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// UserPackage is the type checked package containing input.go, which
+// reco.yml refers to for its types and functions
+type UserPackage struct {
+	fset  *token.FileSet
+	files []*ast.File
+	pkg   *types.Package
+}
+
+// Files generated by tools such as bundle carry this marker, and would
+// otherwise duplicate every declaration in input.go
+var generatedMarker = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.$`)
+
+// LoadPackage parses and type checks the Go files in dir, skipping any
+// in exclude (such as a previously generated mapreduce.go) along with
+// tests and generated files.
+func LoadPackage(dir string, exclude ...string) (*UserPackage, error) {
+	skip := map[string]bool{}
+	for _, e := range exclude {
+		if abs, err := filepath.Abs(e); err == nil {
+			skip[abs] = true
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &UserPackage{fset: token.NewFileSet()}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if skip[abs] || strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if generatedMarker.Match(src) {
+			continue
+		}
+		file, err := parser.ParseFile(p.fset, path, src, 0)
+		if err != nil {
+			return nil, err
+		}
+		p.files = append(p.files, file)
+	}
+
+	if len(p.files) == 0 {
+		return nil, fmt.Errorf("no Go files found in %s", dir)
+	}
+
+	var errs []string
+	conf := types.Config{
+		// The source importer resolves imports through vendor/ and GOPATH,
+		// the same way bundle and reco will
+		Importer: importer.ForCompiler(p.fset, "source", nil),
+		Error: func(err error) {
+			errs = append(errs, err.Error())
+		},
+	}
+	p.pkg, _ = conf.Check(p.files[0].Name.Name, p.fset, p.files, nil)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("type checking %s failed:\n\t%s", dir, strings.Join(errs, "\n\t"))
+	}
+	return p, nil
+}
+
+// LookupType resolves a type expression from reco.yml, such as "Param",
+// "uint32" or "fixed.Int26_6", as it would be seen from within the package
+func (p *UserPackage) LookupType(expr string) (types.Type, error) {
+	var err error
+	// Evaluate within each file in turn, so that types from packages
+	// imported by any of them can be used
+	for _, file := range p.files {
+		var tv types.TypeAndValue
+		tv, err = types.Eval(p.fset, p.pkg, file.Name.Pos(), expr)
+		if terr, ok := err.(types.Error); ok {
+			// Positions within expr aren't useful in reco.yml
+			err = errors.New(terr.Msg)
+		}
+		if err != nil {
+			continue
+		}
+		if !tv.IsType() {
+			return nil, fmt.Errorf("%s is not a type", expr)
+		}
+		return tv.Type, nil
+	}
+	return nil, err
+}
+
+// LookupFunc finds a top level function of the package by name
+func (p *UserPackage) LookupFunc(name string) (*types.Func, error) {
+	obj := p.pkg.Scope().Lookup(name)
+	if obj == nil {
+		return nil, fmt.Errorf("%s is not defined in package %s", name, p.pkg.Name())
+	}
+	f, ok := obj.(*types.Func)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a function", name)
+	}
+	return f, nil
+}
+
+// qualifier prints types of the user package unqualified, and others
+// by their package name, matching how they are written in reco.yml
+func (p *UserPackage) qualifier(other *types.Package) string {
+	if other == p.pkg {
+		return ""
+	}
+	return other.Name()
+}
+
+// typeChecker checks reco.yml against a UserPackage, reporting problems
+// through a validator
+type typeChecker struct {
+	*validator
+	pkg  *UserPackage
+	auto *serializers
+}
+
+// Type resolves a type from reco.yml, reporting it against field if it
+// can't be found
+func (c *typeChecker) Type(field string, expr string) types.Type {
+	t, err := c.pkg.LookupType(expr)
+	if err != nil {
+		c.report(field, "%s", err)
+		return nil
+	}
+	return t
+}
+
+// Signature describes a call the generated code makes. Params and
+// Results use directional channels to describe what's wanted, but any
+// function the call will compile against is accepted.
+type Signature struct {
+	Params  []types.Type
+	Results []types.Type
+}
+
+func (s Signature) String(q types.Qualifier) string {
+	var buf bytes.Buffer
+	buf.WriteString("func(")
+	for i, param := range s.Params {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		types.WriteType(&buf, param, q)
+	}
+	buf.WriteString(")")
+	switch len(s.Results) {
+	case 0:
+	case 1:
+		buf.WriteString(" ")
+		types.WriteType(&buf, s.Results[0], q)
+	default:
+		buf.WriteString(" (")
+		for i, result := range s.Results {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			types.WriteType(&buf, result, q)
+		}
+		buf.WriteString(")")
+	}
+	return buf.String()
+}
+
+// The generated code always passes bidirectional channels
+func argument(t types.Type) types.Type {
+	if ch, ok := t.(*types.Chan); ok {
+		return types.NewChan(types.SendRecv, ch.Elem())
+	}
+	return t
+}
+
+// Func checks that the function named by field can be called as want.
+// Nil types in want are ones that couldn't be resolved, and have
+// already been reported.
+func (c *typeChecker) Func(field string, name string, want Signature) {
+	for _, t := range append(want.Params, want.Results...) {
+		if t == nil {
+			return
+		}
+	}
+
+	f, err := c.pkg.LookupFunc(name)
+	if err != nil {
+		c.report(field, "%s", err)
+		return
+	}
+
+	have := f.Type().(*types.Signature)
+	ok := !have.Variadic() &&
+		have.Params().Len() == len(want.Params) &&
+		have.Results().Len() == len(want.Results)
+	for i := 0; ok && i < len(want.Params); i++ {
+		ok = types.AssignableTo(argument(want.Params[i]), have.Params().At(i).Type())
+	}
+	for i := 0; ok && i < len(want.Results); i++ {
+		ok = types.AssignableTo(have.Results().At(i).Type(), want.Results[i])
+	}
+
+	if !ok {
+		c.report(field, "%s (%s) has type %s, want %s",
+			name, c.pkg.fset.Position(f.Pos()),
+			types.TypeString(have, c.pkg.qualifier), want.String(c.pkg.qualifier))
+	}
+}
+
+func recv(t types.Type) types.Type {
+	if t == nil {
+		return nil
+	}
+	return types.NewChan(types.RecvOnly, t)
+}
+
+func send(t types.Type) types.Type {
+	if t == nil {
+		return nil
+	}
+	return types.NewChan(types.SendOnly, t)
+}
+
+// Param resolves the type of a param, which has to be a scalar to be
+// passed to Top
+func (c *typeChecker) Param(field string, expr string) types.Type {
+	t := c.Type(field, expr)
+	if t == nil {
+		return nil
+	}
+	if basic, ok := t.Underlying().(*types.Basic); !ok || basic.Info()&(types.IsInteger|types.IsBoolean) == 0 {
+		c.report(field, "must be an integer or bool, got %s", types.TypeString(t, c.pkg.qualifier))
+	}
+	return t
+}
+
+// Check verifies that every function named in reco.yml has the signature
+// the generated code will call it with, and fills in any type widths
+// that weren't given.
+func (d *Data) Check(pkg *UserPackage, positions Positions) []Problem {
+	c := &typeChecker{validator: &validator{positions: positions}, pkg: pkg, auto: newSerializers(pkg)}
+	uint32Type := types.Typ[types.Uint32]
+
+	if d.Mode() == ModePipeline {
+		d.checkPipeline(c)
+		d.Serializers = c.auto.Source
+		return c.problems
+	}
+
+	// The types of the arguments holding each element, one for each
+	// input when they're zipped together
+	var elementTypes []types.Type
+	for i := range d.Inputs {
+		input := &d.Inputs[i]
+		field := fmt.Sprintf("inputs[%d]", i)
+		inputType := c.Type(field+".type", input.Type)
+		input.TypeWidth = c.TypeWidth(field+".typeWidth", inputType, input.TypeWidth)
+		input.Deserialize = c.Deserializer(field+".deserialize", input.Deserialize, inputType)
+		elementTypes = append(elementTypes, inputType)
+	}
+	if len(d.Inputs) == 0 {
+		mapperType := c.Type("mapper.type", d.Mapper.Type)
+		if d.ReadsInput() {
+			d.Mapper.TypeWidth = c.TypeWidth("mapper.typeWidth", mapperType, d.Mapper.TypeWidth)
+			d.Mapper.Deserialize = c.Deserializer("mapper.deserialize", d.Mapper.Deserialize, mapperType)
+		} else {
+			c.Func("source.function", d.Source.Function, Signature{
+				Params:  []types.Type{uint32Type},
+				Results: []types.Type{mapperType},
+			})
+		}
+
+		// Mappers are handed windows of elements, rather than single ones
+		if d.Mapper.Window != nil && mapperType != nil {
+			mapperType = types.NewArray(mapperType, int64(d.Mapper.Window.Size))
+		}
+		elementTypes = []types.Type{mapperType}
+	}
+
+	// The type returned by the mapper function
+	var laneType types.Type
+	switch d.Mode() {
+	case ModeReduce, ModeKeyed, ModeScan:
+		laneType = c.Type("reducer.type", d.Reducer.Type)
+	case ModeHistogram:
+		laneType = uint32Type
+	case ModeMap:
+		laneType = c.Type("mapper.output", d.Mapper.Output)
+		d.Mapper.OutputWidth = c.TypeWidth("mapper.outputWidth", laneType, d.Mapper.OutputWidth)
+		d.Mapper.Serialize = c.Serializer("mapper.serialize", d.Mapper.Serialize, laneType)
+	}
+
+	if d.Mapper.Filter != "" {
+		c.Func("mapper.filter", d.Mapper.Filter, Signature{
+			Params:  elementTypes,
+			Results: []types.Type{types.Typ[types.Bool]},
+		})
+	}
+
+	mapperParams := append([]types.Type{}, elementTypes...)
+	if d.Context != nil {
+		// Typed inputs are deserialized, automatically unless told how
+		inputType := types.Type(uint32Type)
+		if d.Context.Input != "" {
+			inputType = c.Type("context.input", d.Context.Input)
+			d.Context.InputWidth = c.TypeWidth("context.inputWidth", inputType, d.Context.InputWidth)
+			if d.Context.Deserialize == "" {
+				d.Context.Deserialize = Auto
+			}
+			d.Context.Deserialize = c.Deserializer("context.deserialize", d.Context.Deserialize, inputType)
+		}
+
+		contextType := c.Type("context.output", d.Context.Output)
+		c.Func("context.function", d.Context.Function, Signature{
+			Params: []types.Type{inputType, send(contextType)},
+		})
+		mapperParams = append([]types.Type{recv(contextType)}, elementTypes...)
+	}
+	// The mapper returns its own output type when it's lifted into the
+	// reducer's type
+	outputType := laneType
+	if d.Reducer != nil && d.Reducer.Lift != "" {
+		outputType = c.Type("mapper.output", d.Mapper.Output)
+		c.Func("reducer.lift", d.Reducer.Lift, Signature{
+			Params:  []types.Type{outputType},
+			Results: []types.Type{laneType},
+		})
+	}
+	// Followed by the index of the element, then any params and tables
+	if d.Mapper.Indexed {
+		mapperParams = append(mapperParams, uint32Type)
+	}
+	for i, param := range d.Params {
+		mapperParams = append(mapperParams, c.Param(fmt.Sprintf("params[%d].type", i), param.Type))
+	}
+	for i := range d.Tables {
+		table := &d.Tables[i]
+		field := fmt.Sprintf("tables[%d]", i)
+		tableType := c.Type(field+".type", table.Type)
+		table.TypeWidth = c.TypeWidth(field+".typeWidth", tableType, table.TypeWidth)
+		if table.Deserialize == "" {
+			table.Deserialize = Auto
+		}
+		table.Deserialize = c.Deserializer(field+".deserialize", table.Deserialize, tableType)
+		if tableType != nil {
+			tableType = types.NewArray(tableType, int64(table.Size))
+		}
+		mapperParams = append(mapperParams, tableType)
+	}
+
+	mapperResults := []types.Type{outputType}
+	if d.Mode() == ModeKeyed {
+		mapperResults = []types.Type{uint32Type, outputType}
+	}
+	// Flat mappers send their outputs instead
+	if d.Mapper.FlatMap {
+		mapperParams = append(mapperParams, send(outputType))
+		mapperResults = nil
+	}
+	c.Func("mapper.function", d.Mapper.Function, Signature{
+		Params:  mapperParams,
+		Results: mapperResults,
+	})
+
+	if d.Reducer != nil {
+		d.Reducer.check(c, laneType)
+	}
+
+	d.Serializers = c.auto.Source
+	return c.problems
+}
+
+func (r *Reducer) check(c *typeChecker, reducerType types.Type) {
+	r.TypeWidth = c.TypeWidth("reducer.typeWidth", reducerType, r.TypeWidth)
+
+	reducerParams := []types.Type{reducerType, reducerType}
+	if r.Nary() && reducerType != nil {
+		reducerParams = []types.Type{types.NewArray(reducerType, int64(r.Fanin()))}
+	}
+	c.Func("reducer.function", r.Function, Signature{
+		Params:  reducerParams,
+		Results: []types.Type{reducerType},
+	})
+	c.Func("reducer.empty", r.Empty, Signature{
+		Results: []types.Type{reducerType},
+	})
+	r.Serialize = c.Serializer("reducer.serialize", r.Serialize, reducerType)
+}
+
+// checkPipeline follows the type of the stream from stage to stage,
+// checking each stage's function against the type coming into it, and
+// filling in the type of any stage that leaves it out.
+func (d *Data) checkPipeline(c *typeChecker) {
+	var stream types.Type
+	for i := range d.Stages {
+		stage := &d.Stages[i]
+		field := fmt.Sprintf("stages[%d]", i)
+
+		if i == 0 {
+			stream = c.Type(field+".type", stage.Type)
+			stage.TypeWidth = c.TypeWidth(field+".typeWidth", stream, stage.TypeWidth)
+			stage.Deserialize = c.Deserializer(field+".deserialize", stage.Deserialize, stream)
+		} else if stage.Type == "" {
+			stage.Type = d.Stages[i-1].OutputType()
+		} else if given := c.Type(field+".type", stage.Type); given != nil && stream != nil && !types.Identical(given, stream) {
+			c.report(field+".type", "is %s, but stages[%d] outputs %s",
+				types.TypeString(given, c.pkg.qualifier), i-1, types.TypeString(stream, c.pkg.qualifier))
+			stream = nil
+		}
+
+		switch stage.Kind {
+		case StageMap:
+			output := c.Type(field+".output", stage.Output)
+			c.Func(field+".function", stage.Function, Signature{
+				Params:  []types.Type{stream},
+				Results: []types.Type{output},
+			})
+			stream = output
+		case StageFilter:
+			c.Func(field+".function", stage.Function, Signature{
+				Params:  []types.Type{stream},
+				Results: []types.Type{types.Typ[types.Bool]},
+			})
+		case StageReduce, StageScan:
+			c.Func(field+".function", stage.Function, Signature{
+				Params:  []types.Type{stream, stream},
+				Results: []types.Type{stream},
+			})
+			c.Func(field+".empty", stage.Empty, Signature{
+				Results: []types.Type{stream},
+			})
+		}
+
+		if i == len(d.Stages)-1 {
+			stage.OutputWidth = c.TypeWidth(field+".outputWidth", stream, stage.OutputWidth)
+			stage.Serialize = c.Serializer(field+".serialize", stage.Serialize, stream)
+		}
+	}
+}
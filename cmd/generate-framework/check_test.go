@@ -0,0 +1,225 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+// The position of a function within testdata, which isn't worth pinning
+var declaredAt = regexp.MustCompile(` \(testdata/[^)]*\)`)
+
+func TestCheck(t *testing.T) {
+	pkg, err := LoadPackage("testdata/check")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		// The field of each problem, along with its message
+		want [][2]string
+	}{
+		{
+			name: "valid",
+			config: `
+mapper:
+  type: Point
+  deserialize: DeserializePoint
+  function: Norm
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+`,
+		},
+		{
+			name: "deserialize of the wrong type",
+			config: `
+mapper:
+  type: Point
+  deserialize: DeserializeWide
+  function: Norm
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+`,
+			want: [][2]string{
+				{"mapper.deserialize", "DeserializeWide has type func(input <-chan uint32, output chan<- uint64), want func(<-chan uint32, chan<- Point)"},
+			},
+		},
+		{
+			name: "mapper returns something other than reducer.type",
+			config: `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Wide
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+`,
+			want: [][2]string{
+				{"mapper.function", "Wide has type func(p Point) uint64, want func(Point) uint32"},
+			},
+		},
+		{
+			name: "empty with arguments",
+			config: `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Norm
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: ZeroFrom
+`,
+			want: [][2]string{
+				{"reducer.empty", "ZeroFrom has type func(seed uint32) uint32, want func() uint32"},
+			},
+		},
+		{
+			name: "context function of the wrong type",
+			config: `
+context:
+  output: uint32
+  function: NoiseWrong
+mapper:
+  type: Point
+  deserialize: auto
+  function: Jitter
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+`,
+			want: [][2]string{
+				{"context.function", "NoiseWrong has type func(seed uint32, output chan<- uint64), want func(uint32, chan<- uint32)"},
+			},
+		},
+		{
+			name: "stage of the wrong type",
+			config: `
+stages:
+  - kind: map
+    type: Point
+    deserialize: auto
+    function: Norm
+    output: uint32
+    replicate: 2
+  - kind: reduce
+    type: Point
+    function: Add
+    empty: Zero
+  - kind: map
+    function: Norm
+    output: uint32
+    replicate: 2
+    serialize: auto
+`,
+			want: [][2]string{
+				// Later stages aren't checked against a stream of unknown type
+				{"stages[1].type", "is Point, but stages[0] outputs uint32"},
+			},
+		},
+		{
+			name: "undefined names",
+			config: `
+mapper:
+  type: Pointy
+  deserialize: auto
+  function: Norm
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Sum
+  empty: Zero
+`,
+			want: [][2]string{
+				{"mapper.type", "undefined: Pointy"},
+				{"reducer.function", "Sum is not defined in package main"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		d, positions, problems, err := readConfig([]byte(test.config))
+		if err != nil || len(problems) != 0 {
+			t.Fatalf("%s: invalid config %v %v", test.name, err, problems)
+		}
+
+		got := [][2]string{}
+		for _, problem := range d.Check(pkg, positions) {
+			got = append(got, [2]string{problem.Field, declaredAt.ReplaceAllString(problem.Message, "")})
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got problems %q, want %q", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got problem %q, want %q", test.name, got[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestCheckInfersWidths(t *testing.T) {
+	pkg, err := LoadPackage("testdata/check")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := Data{
+		Mapper:  Mapper{Type: "Point", Deserialize: Auto, Function: "Norm", Replicate: 1},
+		Reducer: &Reducer{Type: "uint32", Serialize: Auto, Function: "Add", Empty: "Zero"},
+	}
+	if problems := d.Check(pkg, Positions{}); len(problems) != 0 {
+		t.Fatal(problems)
+	}
+	if d.Mapper.TypeWidth != 64 || d.Reducer.TypeWidth != 32 {
+		t.Errorf("inferred widths %d and %d, want 64 and 32", d.Mapper.TypeWidth, d.Reducer.TypeWidth)
+	}
+	if d.Mapper.Deserialize != "autoDeserializePoint" || d.Reducer.Serialize != "autoSerialize_uint32" {
+		t.Errorf("generated %s and %s", d.Mapper.Deserialize, d.Reducer.Serialize)
+	}
+}
+
+func TestCheckPipelineTypes(t *testing.T) {
+	pkg, err := LoadPackage("testdata/check")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := Data{Stages: []Stage{
+		{Kind: StageMap, Type: "Point", Deserialize: Auto, Function: "Norm", Output: "uint32", Replicate: 2},
+		{Kind: StageFilter, Function: "Small"},
+		{Kind: StageReduce, Function: "Add", Empty: "Zero", Serialize: Auto},
+	}}
+	if problems := d.Check(pkg, Positions{}); len(problems) != 0 {
+		t.Fatal(problems)
+	}
+	// Stages that leave out their type take it from the stage before
+	for i, want := range []string{"Point", "uint32", "uint32"} {
+		if d.Stages[i].Type != want {
+			t.Errorf("stages[%d] has type %s, want %s", i, d.Stages[i].Type, want)
+		}
+	}
+	if d.Stages[2].OutputWidth != 32 {
+		t.Errorf("output width %d, want 32", d.Stages[2].OutputWidth)
+	}
+}
@@ -1,8 +1,27 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Context struct {
 	Output   string
 	Function string
+
+	// Each mapper's context is created from a single uint32, unless it's
+	// given an input type
+	Input       string
+	InputWidth  int `yaml:"inputWidth"`
+	Deserialize string
+}
+
+// The type of the input each mapper's context is created from
+func (c Context) InputType() string {
+	if c.Input == "" {
+		return "uint32"
+	}
+	return c.Input
 }
 
 type Mapper struct {
@@ -11,6 +30,43 @@ type Mapper struct {
 	Deserialize string
 	Function    string
 	Replicate   int
+
+	// Without a reducer, each output is serialized and written back
+	Output      string
+	OutputWidth int `yaml:"outputWidth"`
+	Serialize   string
+
+	// Elements rejected by the filter are dropped before the mapper
+	Filter string
+
+	// Each lane folds its own outputs with the reducer, only sending the
+	// result into the tree once the input is done
+	LocalFold bool `yaml:"localFold"`
+
+	// A flat mapper sends any number of outputs for each element on a
+	// chan, rather than returning exactly one
+	FlatMap bool `yaml:"flatMap"`
+
+	// Hand each lane a window of consecutive elements, rather than one
+	Window *Window
+
+	// Pass the index of each element to the mapper, after the element
+	Indexed bool
+}
+
+// Window describes the runs of consecutive elements handed to mappers as
+// [Size]Type. Each window starts Stride elements after the last.
+type Window struct {
+	Size   int
+	Stride int
+}
+
+// How many elements each window moves on by, defaulting to one
+func (w Window) Steps() int {
+	if w.Stride == 0 {
+		return 1
+	}
+	return w.Stride
 }
 
 type Reducer struct {
@@ -20,12 +76,368 @@ type Reducer struct {
 	Function  string
 	Depth     int
 	Empty     string
+	Arity     int
+
+	// With keys, the mapper returns a key along with each value, and
+	// values are reduced per key
+	Keys int
+
+	// Either ScanInclusive or ScanExclusive to write back every prefix
+	// of the reduction, rather than just the total
+	Scan string
+
+	// Turns a mapper output into the reducer's type, when they differ
+	Lift string
+}
+
+const (
+	ScanInclusive = "inclusive"
+	ScanExclusive = "exclusive"
+)
+
+// Fanin is the number of inputs to each reducer, defaulting to binary
+func (r Reducer) Fanin() int {
+	if r.Arity == 0 {
+		return 2
+	}
+	return r.Arity
+}
+
+// Nary reducers take their inputs as a single [Fanin]Type, rather than
+// as two arguments
+func (r Reducer) Nary() bool {
+	return r.Fanin() > 2
+}
+
+// Slots left to fill with Empty in an nary reducer given used inputs
+func (r Reducer) Empties(used int) []int {
+	if !r.Nary() {
+		return nil
+	}
+	return make([]int, r.Fanin()-used)
+}
+
+// Histogram counts how many mapper outputs fall in each bin
+type Histogram struct {
+	Bins int
+}
+
+// Input is one of several buffers read element by element alongside
+// each other, and zipped together for the mappers
+type Input struct {
+	Name        string
+	Type        string
+	TypeWidth   int `yaml:"typeWidth"`
+	Deserialize string
+}
+
+// Source makes the input on chip, instead of reading every element from
+// memory. Either Function generates the element at each index, or with
+// Broadcast, the single element at inputData is used for every index.
+type Source struct {
+	Function  string
+	Broadcast bool
+}
+
+// Param is a scalar passed to Top, and on to every mapper
+type Param struct {
+	Name string
+	Type string
+}
+
+// Table is an array read once from memory, and handed to every mapper
+type Table struct {
+	Name        string
+	Type        string
+	Size        int
+	TypeWidth   int `yaml:"typeWidth"`
+	Deserialize string
+}
+
+// The type mappers are handed the table as
+func (t Table) ArrayType() string {
+	return fmt.Sprintf("[%d]%s", t.Size, t.Type)
+}
+
+// Stage is one step of a pipeline, applied in order to the stream of
+// elements coming out of the stage before it
+type Stage struct {
+	Kind string
+
+	// Type of the elements coming into the stage. Only the first stage
+	// needs it, along with how to deserialize them.
+	Type        string
+	TypeWidth   int `yaml:"typeWidth"`
+	Deserialize string
+
+	Function  string
+	Replicate int
+	// The type a map stage turns each element into
+	Output string
+	Empty  string
+	Scan   string
+
+	// How the last stage's output is written back
+	OutputWidth int `yaml:"outputWidth"`
+	Serialize   string
+}
+
+const (
+	// Apply the function to each element, over replicated lanes
+	StageMap = "map"
+	// Drop elements the function rejects
+	StageFilter = "filter"
+	// Fold every element into a single one
+	StageReduce = "reduce"
+	// Replace each element by the fold of every element up to it
+	StageScan = "scan"
+)
+
+// The type of the elements a stage produces
+func (s Stage) OutputType() string {
+	if s.Kind == StageMap {
+		return s.Output
+	}
+	return s.Type
 }
 
 type Data struct {
-	Context *Context
-	Mapper  Mapper
-	Reducer Reducer
+	Context   *Context
+	Mapper    Mapper
+	Reducer   *Reducer
+	Histogram *Histogram
+	Stages    []Stage
+	Inputs    []Input
+	Params    []Param
+	Tables    []Table
+	Source    *Source
+
+	// Source of any generated (de)serializers
+	Serializers []string `yaml:"-"`
+}
+
+const (
+	// Reduce every output into a single value
+	ModeReduce = "reduce"
+	// Reduce outputs into a table, by key
+	ModeKeyed = "keyed"
+	// Write every output back
+	ModeMap = "map"
+	// Count outputs by bin
+	ModeHistogram = "histogram"
+	// Write back every prefix of the reduction
+	ModeScan = "scan"
+	// Chain stages one after another
+	ModePipeline = "pipeline"
+)
+
+// Mode decides which template generates everything after the mappers
+func (d Data) Mode() string {
+	switch {
+	case len(d.Stages) != 0:
+		return ModePipeline
+	case d.Histogram != nil:
+		return ModeHistogram
+	case d.Reducer == nil:
+		return ModeMap
+	case d.Reducer.Keys != 0:
+		return ModeKeyed
+	case d.Reducer.Scan != "":
+		return ModeScan
+	default:
+		return ModeReduce
+	}
+}
+
+// Conditional on whether a template should write back only some results,
+// after how many there were
+func (d Data) Compact() bool {
+	return d.Mode() == ModeMap && (d.Mapper.Filter != "" || d.Mapper.FlatMap)
+}
+
+// How many kept results are written back in each burst
+const CompactBlock = 16
+
+type CompactSpec struct {
+	// The width of each result
+	Width int
+	Block int
+}
+
+// Describe the writer for kept results of the given width
+func (d Data) CompactWriter(width int) CompactSpec {
+	return CompactSpec{Width: width, Block: CompactBlock}
+}
+
+// Conditional on whether lanes send a flag alongside each output, saying
+// whether it was kept by the filter. Flat mappers just don't send
+// anything for elements that weren't kept.
+func (d Data) KeepFlags() bool {
+	return d.Compact() && !d.Mapper.FlatMap
+}
+
+// The type each mapper lane is handed
+func (d Data) ElementType() string {
+	if len(d.Inputs) != 0 {
+		return "zipElement"
+	}
+	if d.Mapper.Window != nil {
+		return fmt.Sprintf("[%d]%s", d.Mapper.Window.Size, d.Mapper.Type)
+	}
+	return d.Mapper.Type
+}
+
+// The type the mapper function produces
+func (d Data) OutputType() string {
+	switch {
+	case d.Mode() == ModeHistogram:
+		return "uint32"
+	case d.Reducer != nil && d.Reducer.Lift != "":
+		return d.Mapper.Output
+	default:
+		return d.LaneType()
+	}
+}
+
+// The type each mapper lane produces
+func (d Data) LaneType() string {
+	switch d.Mode() {
+	case ModeHistogram:
+		return fmt.Sprintf("[%d]uint32", d.Histogram.Bins)
+	case ModeMap:
+		return d.Mapper.Output
+	default:
+		return d.Reducer.Type
+	}
+}
+
+// The arguments holding the element el, which are its fields when the
+// inputs are zipped together
+func (d Data) ElementArgs() string {
+	if len(d.Inputs) == 0 {
+		return "el"
+	}
+	args := []string{}
+	for _, input := range d.Inputs {
+		args = append(args, "el."+input.Name)
+	}
+	return strings.Join(args, ", ")
+}
+
+// The arguments each mapper lane calls the mapper function with: its
+// context, the element and its index, then any params and tables
+func (d Data) MapperArgs(lane int) string {
+	args := []string{}
+	if d.Context != nil {
+		args = append(args, fmt.Sprintf("context%d", lane))
+	}
+	args = append(args, d.ElementArgs())
+	if d.Mapper.Indexed {
+		args = append(args, "index")
+	}
+	for _, param := range d.Params {
+		args = append(args, param.Name+"Param")
+	}
+	for i := range d.Tables {
+		args = append(args, fmt.Sprintf("table%d", i))
+	}
+	return strings.Join(args, ", ")
+}
+
+// Lift a mapper output held in value into the reducer's type, if needed
+func (d Data) Lift(value string) string {
+	if d.Reducer == nil || d.Reducer.Lift == "" {
+		return value
+	}
+	return fmt.Sprintf("%s(%s)", d.Reducer.Lift, value)
+}
+
+// Reduce value into the accumulator acc, topping up an nary reducer
+// with empty inputs
+func (d Data) Fold(acc string, value string) string {
+	if !d.Reducer.Nary() {
+		return fmt.Sprintf("%s(%s, %s)", d.Reducer.Function, acc, value)
+	}
+	args := []string{acc, value}
+	for range d.Reducer.Empties(2) {
+		args = append(args, d.Reducer.Empty+"()")
+	}
+	return fmt.Sprintf("%s([%d]%s{%s})", d.Reducer.Function, d.Reducer.Fanin(), d.Reducer.Type, strings.Join(args, ", "))
+}
+
+// How many elements of each input are read at a time when zipping them
+const ZipBlock = 16
+
+func (d Data) ZipBlock() int {
+	return ZipBlock
+}
+
+// Conditional on whether Top reads elements from inputData, which a
+// source function does without
+func (d Data) ReadsInput() bool {
+	return d.Source == nil || d.Source.Function == ""
+}
+
+// Suffixes of the memReadAddr and memReadData chans for everything read
+// from memory
+func (d Data) ReadPorts() []string {
+	ret := []string{}
+	if d.Context != nil {
+		ret = append(ret, "Context")
+	}
+	for i := range d.Tables {
+		ret = append(ret, fmt.Sprintf("Table%d", i))
+	}
+	if len(d.Inputs) == 0 {
+		if d.ReadsInput() {
+			ret = append(ret, "Data")
+		}
+		return ret
+	}
+	for i := range d.Inputs {
+		ret = append(ret, fmt.Sprintf("Input%d", i))
+	}
+	return ret
+}
+
+// The suffix of the chans to read port from, which are Top's own when
+// nothing else needs to read memory
+func (d Data) ReadPort(port string) string {
+	if len(d.ReadPorts()) == 1 {
+		return ""
+	}
+	return port
+}
+
+// ArbiterSpec shares the chans with suffix Out between Left and Right
+type ArbiterSpec struct {
+	Out   string
+	Left  string
+	Right string
+}
+
+// Build a tree of two way arbiters over ReadPorts, rooted at Top's own
+// read chans, pairing up neighbouring ports level by level
+func (d Data) Arbiters() []ArbiterSpec {
+	ret := []ArbiterSpec{}
+	ports := d.ReadPorts()
+	for len(ports) > 1 {
+		next := []string{}
+		for i := 0; i < len(ports); i += 2 {
+			if i+1 == len(ports) {
+				next = append(next, ports[i])
+				continue
+			}
+			out := fmt.Sprintf("Arbiter%d", len(ret))
+			if len(ports) == 2 {
+				out = ""
+			}
+			ret = append(ret, ArbiterSpec{Out: out, Left: ports[i], Right: ports[i+1]})
+			next = append(next, out)
+		}
+		ports = next
+	}
+	return ret
 }
 
 type MapperSpec struct {
@@ -49,8 +461,10 @@ func (d Data) UseIntermediate() bool {
 	return (d.Mapper.Replicate >> MaxContextLog) > 0
 }
 
+// One intermediate context feeds each group of 1 << MaxContextLog
+// mappers, the last of which may be partially filled
 func (d Data) Contexts() []ContextSpec {
-	length := d.Mapper.Replicate >> MaxContextLog
+	length := (d.Mapper.Replicate + (1 << MaxContextLog) - 1) >> MaxContextLog
 	ret := make([]ContextSpec, length, length)
 	for i := range ret {
 		ret[i] = ContextSpec{Index: i}
@@ -59,6 +473,134 @@ func (d Data) Contexts() []ContextSpec {
 
 }
 
+// Above this many mappers, elements are dispatched through a tree of
+// intermediate channels rather than a single switch
+const MaxDispatchLog = 4
+
+// The smallest unsigned type that can count every mapper
+func (d Data) CounterType() string {
+	switch {
+	case d.Mapper.Replicate < 1<<8:
+		return "uint8"
+	case d.Mapper.Replicate < 1<<16:
+		return "uint16"
+	default:
+		return "uint32"
+	}
+}
+
+// Conditional on whether a template should use a dispatch tree
+func (d Data) UseDispatchTree() bool {
+	return d.Mapper.Replicate > 1<<MaxDispatchLog
+}
+
+type DispatchChild struct {
+	// Index of the dispatch chan, or the data chan for a Lane
+	Index int
+	// How many consecutive elements of each round go to this child
+	Size int
+	Lane bool
+}
+
+type DispatchSpec struct {
+	Index    int
+	Children []DispatchChild
+}
+
+// Build the dispatch tree, rooted at dispatch0. As elements are handed to
+// mappers in order, each node forwards a run of elements to each of its
+// children in turn, so only needs to count up to the size of its largest
+// child. Nodes have at most 1 << MaxDispatchLog children.
+func (d Data) DispatchNodes() []DispatchSpec {
+	ret := []DispatchSpec{}
+
+	var build func(lo int, hi int) int
+	build = func(lo int, hi int) int {
+		spec := DispatchSpec{Index: len(ret)}
+		ret = append(ret, spec)
+
+		step := 1
+		for step<<MaxDispatchLog < hi-lo {
+			step <<= MaxDispatchLog
+		}
+		for i := lo; i < hi; i += step {
+			end := i + step
+			if end > hi {
+				end = hi
+			}
+			if end-i == 1 {
+				spec.Children = append(spec.Children, DispatchChild{Index: i, Size: 1, Lane: true})
+			} else {
+				spec.Children = append(spec.Children, DispatchChild{Index: build(i, end), Size: end - i})
+			}
+		}
+		ret[spec.Index] = spec
+		return spec.Index
+	}
+	build(0, d.Mapper.Replicate)
+
+	return ret
+}
+
+// A node of the scan network, holding the value at Index after Level
+// steps of a Hillis-Steele scan over the outputs of a single round.
+type ScanNode struct {
+	Level int
+	Index int
+	Next  int
+	// Whether to reduce with the value to the left at the previous level,
+	// or just pass through
+	Left bool
+	// Index of the node at the next level that uses this as its left
+	// input, or -1 if there is none
+	Right int
+	// The last level holds the inclusive prefix of each lane
+	Last bool
+}
+
+// Build the scan network over mapper outputs. At each level, nodes are
+// combined with the node twice as far to their left as the level before,
+// so after log2(mappers) levels each holds the prefix up to itself.
+func (d Data) ScanNodes() []ScanNode {
+	ret := []ScanNode{}
+	levels := logk(2, d.Mapper.Replicate)
+	for level := 0; level <= levels; level++ {
+		for i := 0; i < d.Mapper.Replicate; i++ {
+			node := ScanNode{Level: level, Index: i, Next: level + 1, Right: -1, Last: level == levels}
+			if level > 0 {
+				node.Left = i >= 1<<uint(level-1)
+			}
+			if right := i + 1<<uint(level); !node.Last && right < d.Mapper.Replicate {
+				node.Right = right
+			}
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
+
+type TreeSpec struct {
+	Prefix      string
+	Lanes       string
+	Type        string
+	CounterType string
+	Nodes       []DispatchSpec
+}
+
+// Describe a tree between the root chan prefix0 and the chans lanes0,
+// lanes1... in lane order, with intermediate chans prefix1, prefix2...
+// The same tree gathers lane outputs in order, or scatters elements to
+// each lane in turn.
+func (d Data) Tree(prefix string, lanes string, typ string) TreeSpec {
+	return TreeSpec{
+		Prefix:      prefix,
+		Lanes:       lanes,
+		Type:        typ,
+		CounterType: d.CounterType(),
+		Nodes:       d.DispatchNodes(),
+	}
+}
+
 func (d Data) Mappers() []MapperSpec {
 	ret := make([]MapperSpec, d.Mapper.Replicate, d.Mapper.Replicate)
 	for i := range ret {
@@ -67,48 +609,163 @@ func (d Data) Mappers() []MapperSpec {
 	return ret
 }
 
+// Input index used to feed Reducer.Empty into unfilled reducer inputs
+const EmptyInput = -1
+
 type ReducerSpec struct {
-	Last        bool
 	OutputIndex int
-	InputA      int
-	InputB      int
+	Inputs      []int
 }
 
-func (d Data) Reducers() [][]ReducerSpec {
+// Build the reducer tree level by level, grouping neighbouring channels
+// by the reducer's fanin. When the last group of a level has a single
+// channel it is carried up to the next level unreduced, and any other
+// short group is topped up with empty inputs, so any number of mappers
+// can be reduced. Returns the levels, along with the channels left to be
+// consumed after the last one.
+func (d Data) reducerTree(fanin int, depth int) ([][]ReducerSpec, []int) {
 	ret := [][]ReducerSpec{}
 
-	x := 0
-	p := 0
-	replicate := d.Mapper.Replicate
-	for i := 0; i < d.Reducer.Depth; i++ {
-		lastBlock := i == d.Reducer.Depth-1
+	// Chan index of each input to the current level
+	inputs := make([]int, d.Mapper.Replicate)
+	for i := range inputs {
+		inputs[i] = i
+	}
+	p := d.Mapper.Replicate
+	for i := 0; i < depth; i++ {
 		inner := []ReducerSpec{}
-		for j := 0; j < replicate; j++ {
-			inner = append(inner, ReducerSpec{lastBlock && j == replicate-2, p + replicate, j + x, j + x + 1})
-			j++
+		outputs := []int{}
+		for j := 0; j < len(inputs); j += fanin {
+			end := j + fanin
+			if end > len(inputs) {
+				end = len(inputs)
+			}
+			if end-j == 1 {
+				outputs = append(outputs, inputs[j])
+				continue
+			}
+			group := append([]int{}, inputs[j:end]...)
+			for len(group) < fanin {
+				group = append(group, EmptyInput)
+			}
+			inner = append(inner, ReducerSpec{p, group})
+			outputs = append(outputs, p)
 			p++
 		}
-		// Arg Index
-		x = x + replicate
-		// Chan index
-		p = p + replicate/2
-		replicate = replicate / 2
+		inputs = outputs
 		ret = append(ret, inner)
 	}
+	return ret, inputs
+}
+
+func (d Data) Reducers() [][]ReducerSpec {
+	ret, _ := d.reducerTree(d.Reducer.Fanin(), d.Reducer.Depth)
 	return ret
 }
 
-func (d Data) LastIndex() int {
-	p := 0
-	replicate := d.Mapper.Replicate
-	for i := 0; i < d.Reducer.Depth; i++ {
-		for j := 0; j < replicate; j++ {
-			j++
-			p++
+// A full binary tree of adders, merging the bins counted by each mapper
+func (d Data) Adders() [][]ReducerSpec {
+	ret, _ := d.reducerTree(2, logk(2, d.Mapper.Replicate))
+	return ret
+}
+
+// The chan holding the total of every bin
+func (d Data) AdderOutput() int {
+	_, outputs := d.reducerTree(2, logk(2, d.Mapper.Replicate))
+	return outputs[0]
+}
+
+// Chan indices left unconsumed by the reducer tree, which the final
+// accumulator folds in sequence. This is a single chan for a full depth
+// tree, and more when the tree is cut short to save area.
+func (d Data) LastIndices() []int {
+	_, outputs := d.reducerTree(d.Reducer.Fanin(), d.Reducer.Depth)
+	return outputs
+}
+
+// Groups of LastIndices for each step of the final accumulator. Each step
+// reduces the accumulator along with up to Fanin - 1 outputs, topped up
+// with empty inputs.
+func (d Data) Accumulate() [][]int {
+	ret := [][]int{}
+	outputs := d.LastIndices()
+	width := d.Reducer.Fanin() - 1
+	for j := 0; j < len(outputs); j += width {
+		group := []int{}
+		for k := j; k < j+width; k++ {
+			if k < len(outputs) {
+				group = append(group, outputs[k])
+			} else {
+				group = append(group, EmptyInput)
+			}
+		}
+		ret = append(ret, group)
+	}
+	return ret
+}
+
+// StageSpec describes how a pipeline stage is wired up to its neighbours
+type StageSpec struct {
+	Stage
+	Index int
+	Next  int
+	// Whether the stream into, and out of, this stage has a chan of flags
+	// alongside it, saying which elements were kept by a filter
+	Kept    bool
+	KeptOut bool
+	// How many elements the streams into, and out of, this stage have,
+	// which is only one after a reduce
+	Count    string
+	CountOut string
+}
+
+// The chans and counter of a map stage are sized by its own replicate
+func (s StageSpec) lanes() Data {
+	return Data{Mapper: Mapper{Replicate: s.Replicate}}
+}
+
+func (s StageSpec) CounterType() string {
+	return s.lanes().CounterType()
+}
+
+func (s StageSpec) Lanes() []MapperSpec {
+	return s.lanes().Mappers()
+}
+
+// A tree over the lanes of a map stage, with chans named after the stage
+func (s StageSpec) Tree(prefix string, lanes string, typ string) TreeSpec {
+	return s.lanes().Tree(fmt.Sprintf("stage%d%s", s.Index, prefix), fmt.Sprintf("stage%d%s", s.Index, lanes), typ)
+}
+
+// Wire up each stage to read from stream<Index> and write to
+// stream<Next>, working out which streams carry keep flags and how long
+// each of them is
+func (d Data) Pipeline() []StageSpec {
+	ret := make([]StageSpec, len(d.Stages))
+	kept := false
+	count := "length"
+	for i, stage := range d.Stages {
+		spec := StageSpec{Stage: stage, Index: i, Next: i + 1, Kept: kept, Count: count}
+		switch stage.Kind {
+		case StageFilter:
+			kept = true
+		case StageReduce:
+			kept = false
+			count = "1"
 		}
-		// Chan index
-		p = p + replicate/2
-		replicate = replicate / 2
+		spec.KeptOut = kept
+		spec.CountOut = count
+		ret[i] = spec
 	}
-	return p
+	return ret
+}
+
+// The first and last stages read and write memory
+func (d Data) FirstStage() Stage {
+	return d.Stages[0]
+}
+
+func (d Data) LastStage() StageSpec {
+	stages := d.Pipeline()
+	return stages[len(stages)-1]
 }
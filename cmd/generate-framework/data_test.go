@@ -0,0 +1,310 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mappers(replicate int) Data {
+	return Data{Mapper: Mapper{Replicate: replicate}}
+}
+
+func laneRange(lo int, hi int) []int {
+	ret := []int{}
+	for i := lo; i < hi; i++ {
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+// reduceLanes follows the reducer tree, returning the lanes that end up
+// in each of the chans left over after the last level
+func reduceLanes(t *testing.T, d Data, fanin int, depth int) [][]int {
+	levels, outputs := d.reducerTree(fanin, depth)
+	if len(levels) != depth {
+		t.Fatalf("%d levels, want %d", len(levels), depth)
+	}
+
+	lanes := map[int][]int{}
+	for i := 0; i < d.Mapper.Replicate; i++ {
+		lanes[i] = []int{i}
+	}
+	for _, level := range levels {
+		for _, spec := range level {
+			if len(spec.Inputs) != fanin {
+				t.Fatalf("reducer %d has %d inputs, want %d", spec.OutputIndex, len(spec.Inputs), fanin)
+			}
+			if _, ok := lanes[spec.OutputIndex]; ok {
+				t.Fatalf("chan %d is written twice", spec.OutputIndex)
+			}
+			out := []int{}
+			for _, input := range spec.Inputs {
+				if input == EmptyInput {
+					continue
+				}
+				in, ok := lanes[input]
+				if !ok {
+					t.Fatalf("reducer %d reads chan %d, which is never written or already read", spec.OutputIndex, input)
+				}
+				out = append(out, in...)
+				delete(lanes, input)
+			}
+			lanes[spec.OutputIndex] = out
+		}
+	}
+
+	if len(lanes) != len(outputs) {
+		t.Fatalf("%d chans left unread, but %d outputs", len(lanes), len(outputs))
+	}
+	ret := [][]int{}
+	for _, output := range outputs {
+		ret = append(ret, lanes[output])
+	}
+	return ret
+}
+
+func TestReducerTree(t *testing.T) {
+	tests := []struct {
+		replicate int
+		fanin     int
+		depth     int
+		want      [][]int
+	}{
+		{1, 2, 0, [][]int{{0}}},
+		{4, 2, 2, [][]int{{0, 1, 2, 3}}},
+		{5, 2, 3, [][]int{{0, 1, 2, 3, 4}}},
+		{12, 2, 2, [][]int{{0, 1, 2, 3}, {4, 5, 6, 7}, {8, 9, 10, 11}}},
+		{7, 3, 1, [][]int{{0, 1, 2}, {3, 4, 5}, {6}}},
+		{7, 3, 2, [][]int{{0, 1, 2, 3, 4, 5, 6}}},
+		{10, 4, 1, [][]int{{0, 1, 2, 3}, {4, 5, 6, 7}, {8, 9}}},
+		{10, 4, 2, [][]int{laneRange(0, 10)}},
+		{300, 2, 9, [][]int{laneRange(0, 300)}},
+	}
+
+	for _, test := range tests {
+		got := reduceLanes(t, mappers(test.replicate), test.fanin, test.depth)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("replicate %d, fanin %d, depth %d: outputs hold %v, want %v", test.replicate, test.fanin, test.depth, got, test.want)
+		}
+	}
+}
+
+func TestLastIndices(t *testing.T) {
+	d := mappers(12)
+	d.Reducer = &Reducer{Depth: 2}
+	if got := len(d.LastIndices()); got != 3 {
+		t.Errorf("replicate 12 at depth 2 leaves %d outputs, want 3", got)
+	}
+
+	d.Reducer.Depth = logk(2, 12)
+	if got := len(d.LastIndices()); got != 1 {
+		t.Errorf("replicate 12 at full depth leaves %d outputs, want 1", got)
+	}
+}
+
+func TestDispatchNodes(t *testing.T) {
+	tests := []struct {
+		replicate int
+		// Sizes of the children of dispatch0
+		want []int
+	}{
+		{3, []int{1, 1, 1}},
+		{16, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{17, []int{16, 1}},
+		{40, []int{16, 16, 8}},
+		{300, []int{256, 44}},
+	}
+
+	for _, test := range tests {
+		nodes := mappers(test.replicate).DispatchNodes()
+
+		sizes := []int{}
+		for _, child := range nodes[0].Children {
+			sizes = append(sizes, child.Size)
+		}
+		if !reflect.DeepEqual(sizes, test.want) {
+			t.Errorf("replicate %d: dispatch0 splits into %v, want %v", test.replicate, sizes, test.want)
+		}
+
+		// Walking the tree in order must reach every lane once, in order
+		var walk func(index int) []int
+		walk = func(index int) []int {
+			if len(nodes[index].Children) > 1<<MaxDispatchLog {
+				t.Errorf("replicate %d: dispatch%d has %d children", test.replicate, index, len(nodes[index].Children))
+			}
+			ret := []int{}
+			for _, child := range nodes[index].Children {
+				if child.Lane {
+					ret = append(ret, child.Index)
+					continue
+				}
+				below := walk(child.Index)
+				if len(below) != child.Size {
+					t.Errorf("replicate %d: dispatch%d has size %d, but reaches %d lanes", test.replicate, child.Index, child.Size, len(below))
+				}
+				ret = append(ret, below...)
+			}
+			return ret
+		}
+		if got := walk(0); !reflect.DeepEqual(got, laneRange(0, test.replicate)) {
+			t.Errorf("replicate %d: dispatch reaches lanes %v", test.replicate, got)
+		}
+	}
+}
+
+func TestScanNodes(t *testing.T) {
+	for _, replicate := range []int{1, 2, 3, 5, 8, 13} {
+		nodes := mappers(replicate).ScanNodes()
+
+		// Sum lane indices through the network, which should leave the
+		// prefix sum of each lane at the last level
+		values := map[[2]int]int{}
+		for _, node := range nodes {
+			key := [2]int{node.Level, node.Index}
+			if node.Level == 0 {
+				values[key] = node.Index
+				continue
+			}
+			values[key] = values[[2]int{node.Level - 1, node.Index}]
+			if node.Left {
+				left := node.Index - 1<<uint(node.Level-1)
+				values[key] += values[[2]int{node.Level - 1, left}]
+			}
+		}
+
+		for _, node := range nodes {
+			if node.Right >= 0 {
+				right := nodes[(node.Level+1)*replicate+node.Right]
+				if !right.Left || right.Index-1<<uint(node.Level) != node.Index {
+					t.Errorf("replicate %d: node %d at level %d feeds %d, which doesn't read it", replicate, node.Index, node.Level, node.Right)
+				}
+			}
+			if !node.Last {
+				continue
+			}
+			if want := node.Index * (node.Index + 1) / 2; values[[2]int{node.Level, node.Index}] != want {
+				t.Errorf("replicate %d: lane %d scans to %d, want %d", replicate, node.Index, values[[2]int{node.Level, node.Index}], want)
+			}
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	type flow struct {
+		Kept, KeptOut   bool
+		Count, CountOut string
+	}
+	tests := []struct {
+		name  string
+		kinds []string
+		want  []flow
+	}{
+		{
+			"filter then scan",
+			[]string{StageFilter, StageScan, StageMap},
+			[]flow{
+				{false, true, "length", "length"},
+				{true, true, "length", "length"},
+				{true, true, "length", "length"},
+			},
+		},
+		{
+			"reduce then map",
+			[]string{StageMap, StageReduce, StageMap},
+			[]flow{
+				{false, false, "length", "length"},
+				{false, false, "length", "1"},
+				{false, false, "1", "1"},
+			},
+		},
+		{
+			"filter then reduce",
+			[]string{StageFilter, StageReduce, StageFilter},
+			[]flow{
+				{false, true, "length", "length"},
+				{true, false, "length", "1"},
+				{false, true, "1", "1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var d Data
+		for _, kind := range test.kinds {
+			d.Stages = append(d.Stages, Stage{Kind: kind})
+		}
+		for i, spec := range d.Pipeline() {
+			if spec.Index != i || spec.Next != i+1 {
+				t.Errorf("%s: stages[%d] reads stream%d and writes stream%d", test.name, i, spec.Index, spec.Next)
+			}
+			if got := (flow{spec.Kept, spec.KeptOut, spec.Count, spec.CountOut}); got != test.want[i] {
+				t.Errorf("%s: stages[%d] is %+v, want %+v", test.name, i, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestArbiters(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Data
+		want []string
+	}{
+		{"input", Data{}, []string{"Data"}},
+		{"source and context", Data{Context: &Context{}, Source: &Source{Function: "Gen"}}, []string{"Context"}},
+		{"context", Data{Context: &Context{}}, []string{"Context", "Data"}},
+		{"context and table", Data{Context: &Context{}, Tables: make([]Table, 1)}, []string{"Context", "Table0", "Data"}},
+		{"zip", Data{Context: &Context{}, Tables: make([]Table, 2), Inputs: make([]Input, 2)}, []string{"Context", "Table0", "Table1", "Input0", "Input1"}},
+	}
+
+	for _, test := range tests {
+		ports := test.d.ReadPorts()
+		if !reflect.DeepEqual(ports, test.want) {
+			t.Errorf("%s: read ports %v, want %v", test.name, ports, test.want)
+			continue
+		}
+
+		if len(ports) == 1 {
+			// A single port reads through Top's own chans
+			if got := test.d.ReadPort(ports[0]); got != "" {
+				t.Errorf("%s: only port reads from memReadAddr%s", test.name, got)
+			}
+			if arbiters := test.d.Arbiters(); len(arbiters) != 0 {
+				t.Errorf("%s: %d arbiters for a single port", test.name, len(arbiters))
+			}
+			continue
+		}
+		for _, port := range ports {
+			if got := test.d.ReadPort(port); got != port {
+				t.Errorf("%s: %s reads from memReadAddr%s", test.name, port, got)
+			}
+		}
+
+		// Every port, and every arbiter but the root, has to be read by
+		// exactly one arbiter after its chans are made
+		unread := map[string]bool{}
+		for _, port := range ports {
+			unread[port] = true
+		}
+		root := 0
+		for _, arbiter := range test.d.Arbiters() {
+			for _, in := range []string{arbiter.Left, arbiter.Right} {
+				if !unread[in] {
+					t.Errorf("%s: memReadAddr%s isn't there to be shared", test.name, in)
+				}
+				delete(unread, in)
+			}
+			if arbiter.Out == "" {
+				root++
+			} else {
+				unread[arbiter.Out] = true
+			}
+		}
+		if root != 1 {
+			t.Errorf("%s: %d arbiters use Top's own chans, want 1", test.name, root)
+		}
+		if len(unread) != 0 {
+			t.Errorf("%s: %v never reach memory", test.name, unread)
+		}
+	}
+}
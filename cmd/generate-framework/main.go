@@ -3,15 +3,19 @@ package main
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"go/format"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 	"text/template"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
-var program = `package main
+var program = `// Code generated by generate-framework. DO NOT EDIT.
+
+package main
         import (
                 // Import the entire framework
                 _ "github.com/ReconfigureIO/sdaccel"
@@ -21,12 +25,24 @@ var program = `package main
         )
 
         func Top(
+                {{ range .Inputs }}
+                {{ .Name }}Data uintptr,
+                {{ else }}
+                {{ if .ReadsInput }}
         		inputData uintptr,
+                {{ end }}
+                {{ end }}
         		outputData uintptr,
                 {{ if .Context }}
                 contextData uintptr,
+                {{ end }}
+                {{ range .Tables }}
+                {{ .Name }}Table uintptr,
                 {{ end }}
         		length uint32,
+                {{ range .Params }}
+                {{ .Name }}Param {{ .Type }},
+                {{ end }}
                 // The second set of arguments will be the ports for interacting with memory
                 memReadAddr chan<- axiprotocol.Addr,
                 memReadData <-chan axiprotocol.ReadData,
@@ -37,24 +53,42 @@ var program = `package main
 
 
 
-        {{ if .Context }}
-        memReadAddrContext := make(chan axiprotocol.Addr)
-        memReadDataContext := make(chan axiprotocol.ReadData)
+        {{ if .Arbiters }}
+        // Share the read channel between everything read from memory
+        {{ range .ReadPorts }}
+        memReadAddr{{ . }} := make(chan axiprotocol.Addr)
+        memReadData{{ . }} := make(chan axiprotocol.ReadData)
+        {{ end }}
 
-        memReadAddrData := make(chan axiprotocol.Addr)
-        memReadDataData := make(chan axiprotocol.ReadData)
+        {{ range .Arbiters }}
+        {{ if .Out }}
+        memReadAddr{{ .Out }} := make(chan axiprotocol.Addr)
+        memReadData{{ .Out }} := make(chan axiprotocol.ReadData)
+        {{ end }}
+        go arbitrate.ReadArbitrateX2(memReadAddr{{ .Out }}, memReadData{{ .Out }}, memReadAddr{{ .Left }}, memReadData{{ .Left }}, memReadAddr{{ .Right }}, memReadData{{ .Right }})
+        {{ end }}
+        {{ end }}
 
-        go arbitrate.ReadArbitrateX2(memReadAddr, memReadData, memReadAddrContext, memReadDataContext, memReadAddrData, memReadDataData)
+        {{ if .Context }}
+        {{ if .Context.Input }}
+        // Read an input for each mapper's context
+        contextWords := make(chan uint32, 1)
+        go aximemory.ReadBurstUInt32(
+                memReadAddr{{ .ReadPort "Context" }}, memReadData{{ .ReadPort "Context" }}, true, contextData, {{ .Mapper.Replicate }} * ({{ .Context.InputWidth }} / 32), contextWords)
 
+        contextChan := make(chan {{ .Context.InputType }}, 1)
+        go {{ .Context.Deserialize }}(contextWords, contextChan)
+        {{ else }}
         contextChan := make(chan uint32, 1)
         go aximemory.ReadBurstUInt32(
-                memReadAddrContext, memReadDataContext, true, contextData, {{ .Mapper.Replicate }}, contextChan)
+                memReadAddr{{ .ReadPort "Context" }}, memReadData{{ .ReadPort "Context" }}, true, contextData, {{ .Mapper.Replicate }}, contextChan)
+        {{ end }}
 
         {{ if .UseIntermediate }}
 
         // Intermediate chans
         {{ range $index, $spec := .Contexts -}}
-        intermediateContext{{ $spec.Index }} := make(chan uint32, 1)
+        intermediateContext{{ $spec.Index }} := make(chan {{ $.Context.InputType }}, 1)
         {{ end }}
 
         go func(){
@@ -90,41 +124,98 @@ var program = `package main
         {{ end }}
         {{ end }}
 
+        {{ range $index, $table := .Tables }}
+        // Load the {{ .Name }} table before any mapper needs it
+        table{{ $index }}Words := make(chan uint32, 1)
+        go aximemory.ReadBurstUInt32(
+                memReadAddr{{ $.ReadPort (printf "Table%d" $index) }}, memReadData{{ $.ReadPort (printf "Table%d" $index) }}, true, {{ .Name }}Table, {{ .Size }} * ({{ .TypeWidth }} / 32), table{{ $index }}Words)
+
+        table{{ $index }}Elements := make(chan {{ .Type }}, 1)
+        go {{ .Deserialize }}(table{{ $index }}Words, table{{ $index }}Elements)
+
+        var table{{ $index }} {{ .ArrayType }}
+        for i := 0; i < {{ .Size }}; i++ {
+            table{{ $index }}[i] = <-table{{ $index }}Elements
+        }
+        {{ end }}
+
+        {{ if eq .Mode "pipeline" }}
+        {{ template "pipeline" . }}
+        {{ else }}
+
+        {{ if .Inputs }}
+        {{ template "zip" . }}
+        {{ else if .Source }}
+        {{ template "source" . }}
+        {{ else }}
         // Read all of the input data into a channel
         inputChan := make(chan uint32, {{ .Mapper.Replicate }})
 
-        {{ if .Context }}
-        go aximemory.ReadBurstUInt32(
-                memReadAddrData, memReadDataData, true, inputData, length * ({{ .Mapper.TypeWidth }} / 32), inputChan)
-        {{ else }}
         go aximemory.ReadBurstUInt32(
-                memReadAddr, memReadData, true, inputData, length * ({{ .Mapper.TypeWidth }} / 32), inputChan)
-        {{ end }}
+                memReadAddr{{ .ReadPort "Data" }}, memReadData{{ .ReadPort "Data" }}, true, inputData, length * ({{ .Mapper.TypeWidth }} / 32), inputChan)
 
 
         // Read all of the input data into a channel
         elementChan := make(chan {{ .Mapper.Type }}, 1)
         go {{ .Mapper.Deserialize }}(inputChan, elementChan)
+        {{ end }}
+
+        {{ with .Mapper.Window }}
+        // Slide a window over the input, handing on each full one as a
+        // single element
+        windowChan := make(chan {{ $.ElementType }}, 1)
+        go func() {
+            var window {{ $.ElementType }}
+            // The input index that completes the next window
+            next := uint32({{ .Size }} - 1)
+            for i := uint32(0); i < length; i++ {
+                for j := 0; j < {{ .Size }} - 1; j++ {
+                    window[j] = window[j + 1]
+                }
+                window[{{ .Size }} - 1] = <-elementChan
+                if i == next {
+                    windowChan <- window
+                    next += {{ .Steps }}
+                }
+            }
+        }()
+
+        // Only full windows are mapped
+        elements := uint32(0)
+        if length >= {{ .Size }} {
+            elements = (length - {{ .Size }}) / {{ .Steps }} + 1
+        }
+        {{ else }}
+        elements := length
+        {{ end }}
 
         // Read all of the input data into a channel
         // dataChan := make(chan [{{ .Mapper.Replicate }}]{{ .Mapper.Type }}, 1)
 
         {{ range $index, $spec := .Mappers }}
-        data{{ $spec.Index }} := make(chan {{ $.Mapper.Type }}, 1)
+        data{{ $spec.Index }} := make(chan {{ $.ElementType }}, 1)
         {{ end }}
 
 
+        {{ if .UseDispatchTree }}
+        // Dispatch tree
+        {{ template "scatter" (.Tree "dispatch" "data" .ElementType) }}
+        {{ end }}
+
         // Dispatch
         go func() {
-            for n := length; n != 0;  {
-                for i := uint8(0); i < {{ .Mapper.Replicate }}; i++ {
-                    var el {{ .Mapper.Type }}
+            for n := elements; n != 0;  {
+                for i := {{ .CounterType }}(0); i < {{ .Mapper.Replicate }}; i++ {
+                    var el {{ .ElementType }}
                     if uint32(i) < n {
-                        el = <-elementChan
+                        el = <-{{ if .Mapper.Window }}windowChan{{ else }}elementChan{{ end }}
                     }else{
-                        el = [1]{{ .Mapper.Type}}{}[0]
+                        el = [1]{{ .ElementType }}{}[0]
                     }
 
+                    {{ if .UseDispatchTree }}
+                    dispatch0 <- el
+                    {{ else }}
                     {{ range $index, $spec := .Mappers }}
                        el{{ $spec.Index }} := el
                     {{ end }}
@@ -136,6 +227,7 @@ var program = `package main
                                            data{{ $spec.Index }} <- el{{ $spec.Index }}
                            {{ end }}
                     }
+                    {{ end }}
                 }
 
                 if n < {{ .Mapper.Replicate }} {
@@ -146,68 +238,97 @@ var program = `package main
             }
         } ()
 
-                val := make(chan {{ .Reducer.Type }}, 1)
-
                 // Mapper part
 
-                {{ range $index, $spec := .Mappers }}
-              	c{{ $spec.Index }} := make(chan {{ $.Reducer.Type }}, 1)
-            	go func() {
-                    for {
-                    {{ if $.Context }}
-        	    	c{{ $spec.Index }} <- {{ $.Mapper.Function }}(context{{ $spec.Index }}, <-data{{ $spec.Index }})
-                    {{ else }}
-        	    	c{{ $spec.Index }} <- {{ $.Mapper.Function }}(<-data{{ $spec.Index }})
-                    {{ end }}
-                    }
-            	}()
-                {{ end }}
+                {{ template "lanes" . }}
 
-                // Reducer part
-                {{ range $index, $element := .Reducers }}
-                {{ range $index, $spec := $element }}
-                    c{{ $spec.OutputIndex }} := make(chan {{ $.Reducer.Type }}, 1)
-                 	go func() {
-			for{
-         	        	c{{ $spec.OutputIndex }} <- {{ $.Reducer.Function }}(<-c{{ $spec.InputA }}, <-c{{ $spec.InputB }})
-			}
-                 	}()
-                     {{ end }}
-                     {{ end }}
-
-                	go func() {
-			for{
-                		val <- <-c{{ .LastIndex }}
-            		}
-			}()
-
-        retChan := make(chan {{ .Reducer.Type }})
-        outputDataChan := make(chan uint32)
-
-        go func(){
-            var ret {{ .Reducer.Type }}
-            toRead := uint32({{ .Mapper.Replicate }})
-            ret = {{ .Reducer.Empty }}()
-            for n := length; n > 0; n -= toRead {
-                if n < toRead {
-                   toRead = n
-                }
-                ret = {{ .Reducer.Function }}(ret, <-val)
-            }
-            retChan <- ret
-        }()
-
-        go {{ .Reducer.Serialize }}(retChan, outputDataChan)
+        {{ if eq .Mode "reduce" }}
+        {{ template "reduce" . }}
+        {{ else if eq .Mode "keyed" }}
+        {{ template "keyed" . }}
+        {{ else if eq .Mode "histogram" }}
+        {{ template "histogram" . }}
+        {{ else if eq .Mode "scan" }}
+        {{ template "scan" . }}
+        {{ else }}
+        {{ template "map" . }}
+        {{ end }}
+        {{ end }}
+        }
 
-        // Write it back to the pointer the host requests
-        aximemory.WriteBurstUInt32(
-                memWriteAddr, memWriteData, memWriteResp, true, outputData, {{ .Reducer.TypeWidth }} / 32, outputDataChan)
+        {{ if .Inputs }}
+        // An element of each input, zipped together for the mappers
+        type zipElement struct {
+            {{ range .Inputs }}
+            {{ .Name }} {{ .Type }}
+            {{ end }}
         }
+        {{ end }}
+
+        {{ range .Serializers }}
+        {{ . }}
+        {{ end }}
 `
 
+// generate executes the program template over a checked config, returning
+// the formatted source of Top
+func generate(d Data) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	t := template.Must(template.New("main").Parse(program))
+	template.Must(t.New("zip").Parse(zip))
+	template.Must(t.New("source").Parse(source))
+	template.Must(t.New("lanes").Parse(lanes))
+	template.Must(t.New("reduce").Parse(reduce))
+	template.Must(t.New("accumulate").Parse(accumulate))
+	template.Must(t.New("map").Parse(mapOnly))
+	template.Must(t.New("keyed").Parse(keyed))
+	template.Must(t.New("histogram").Parse(histogram))
+	template.Must(t.New("scan").Parse(scan))
+	template.Must(t.New("pipeline").Parse(pipeline))
+	template.Must(t.New("compact").Parse(compact))
+	template.Must(t.New("gather").Parse(gather))
+	template.Must(t.New("gatherFlat").Parse(gatherFlat))
+	template.Must(t.New("scatter").Parse(scatter))
+	if err := t.Execute(&buffer, d); err != nil {
+		return nil, fmt.Errorf("template %s", err)
+	}
+
+	data, err := format.Source(buffer.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format %s\n%s", err, buffer.String())
+	}
+	return data, nil
+}
+
+// readConfig parses reco.yml, returning any settings it doesn't know
+// along with every other problem found by Validate
+func readConfig(src []byte) (Data, Positions, []Problem, error) {
+	var d Data
+	positions := indexPositions(src)
+	problems, err := yamlProblems(yaml.UnmarshalStrict(src, &d), positions)
+	if err != nil {
+		return d, positions, nil, err
+	}
+	return d, positions, append(problems, d.Validate(positions)...), nil
+}
+
+// Report any problems found with the config, and stop before generating
+// anything from it
+func checkProblems(configPath string, filename string, problems []Problem) {
+	if len(problems) == 0 {
+		return
+	}
+	for _, problem := range problems {
+		log.Printf("%s:%s", configPath, problem)
+	}
+	log.Fatalf("%s has %d problem(s), not generating %s", configPath, len(problems), filename)
+}
+
 func main() {
 	var filename = flag.String("output", "mapreduce.go", "output file name")
 	var configPath = flag.String("config", "reco.yml", "config file location")
+	var packageDir = flag.String("package", "", "directory of the package reco.yml refers to (default is the config file's directory)")
 	flag.Parse()
 
 	configFile, err := ioutil.ReadFile(*configPath)
@@ -216,26 +337,25 @@ func main() {
 		log.Fatal("Error opening config file", err)
 	}
 
-	var funcs = template.FuncMap{}
-
-	var buffer bytes.Buffer
-
-	var d Data
-
-	err = yaml.Unmarshal(configFile, &d)
+	d, positions, problems, err := readConfig(configFile)
 	if err != nil {
 		log.Fatal("Error reading config file", err)
 	}
+	checkProblems(*configPath, *filename, problems)
 
-	// Generate main()
-	t := template.Must(template.New("main").Funcs(funcs).Parse(program))
-	if err := t.Execute(&buffer, d); err != nil {
-		log.Fatal("template", err)
+	dir := *packageDir
+	if dir == "" {
+		dir = filepath.Dir(*configPath)
 	}
+	pkg, err := LoadPackage(dir, *filename)
+	if err != nil {
+		log.Fatal("Error loading package ", err)
+	}
+	checkProblems(*configPath, *filename, d.Check(pkg, positions))
 
-	data, err := format.Source(buffer.Bytes())
+	data, err := generate(d)
 	if err != nil {
-		log.Fatal("format ", err, string(buffer.Bytes()))
+		log.Fatal(err)
 	}
 
 	if err := ioutil.WriteFile(*filename, data, 0644); err != nil {
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// One config for each mode, and for each option that changes what's
+// generated, so that a broken branch of a template is caught without
+// running generate-framework by hand
+var generateTests = []struct {
+	name   string
+	config string
+}{
+	{"reduce", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Norm
+  replicate: 5
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+  depth: 3
+`},
+	{"reduce arity and partial depth", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Norm
+  filter: Near
+  replicate: 40
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add4
+  empty: Zero
+  arity: 4
+  depth: 1
+`},
+	{"lift and localFold", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Norm
+  output: uint32
+  localFold: true
+  replicate: 6
+reducer:
+  type: Stats
+  serialize: auto
+  function: Merge
+  lift: Lift
+  empty: Empty
+  depth: 2
+`},
+	{"map", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Norm
+  replicate: 20
+  output: uint32
+  serialize: auto
+`},
+	{"map filter", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Norm
+  filter: Near
+  replicate: 3
+  output: uint32
+  serialize: auto
+`},
+	{"map flatMap", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Corners
+  flatMap: true
+  replicate: 4
+  output: Point
+  serialize: auto
+`},
+	{"map window", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Smooth
+  window:
+    size: 3
+    stride: 2
+  replicate: 4
+  output: Point
+  serialize: auto
+`},
+	{"keyed", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Quadrant
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+  keys: 2
+`},
+	{"histogram", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Bin
+  replicate: 17
+histogram:
+  bins: 16
+`},
+	{"scan", `
+mapper:
+  type: Point
+  deserialize: auto
+  function: Norm
+  replicate: 5
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+  scan: exclusive
+`},
+	{"context", `
+context:
+  output: uint32
+  function: Noise
+mapper:
+  type: Point
+  deserialize: auto
+  function: Jitter
+  replicate: 20
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+`},
+	{"typed context", `
+context:
+  input: Seed
+  output: uint32
+  function: SeededNoise
+mapper:
+  type: Point
+  deserialize: auto
+  function: Jitter
+  replicate: 3
+  output: uint32
+  serialize: auto
+`},
+	{"zip", `
+inputs:
+  - name: as
+    type: Point
+    deserialize: auto
+  - name: bs
+    type: Point
+    deserialize: auto
+mapper:
+  function: Dot
+  replicate: 3
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+`},
+	{"indexed with params and tables", `
+params:
+  - name: scale
+    type: uint32
+tables:
+  - name: weights
+    type: uint32
+    size: 8
+mapper:
+  type: Point
+  deserialize: auto
+  function: Weigh
+  indexed: true
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+`},
+	{"source function", `
+source:
+  function: Origin
+context:
+  output: uint32
+  function: Noise
+mapper:
+  type: Point
+  function: Jitter
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+`},
+	{"source broadcast", `
+source:
+  broadcast: true
+mapper:
+  type: Point
+  deserialize: auto
+  function: Norm
+  replicate: 4
+  output: uint32
+  serialize: auto
+`},
+	{"pipeline", `
+stages:
+  - kind: filter
+    type: uint32
+    deserialize: auto
+    function: Even
+  - kind: map
+    function: Double
+    output: uint32
+    replicate: 3
+  - kind: scan
+    function: Add
+    empty: Zero
+  - kind: reduce
+    function: Add
+    empty: Zero
+  - kind: map
+    function: Double
+    output: uint32
+    replicate: 2
+    serialize: auto
+`},
+}
+
+func TestGenerate(t *testing.T) {
+	pkg, err := LoadPackage("testdata/generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range generateTests {
+		d, positions, problems, err := readConfig([]byte(test.config))
+		if err != nil || len(problems) != 0 {
+			t.Errorf("%s: invalid config %v %v", test.name, err, problems)
+			continue
+		}
+		if problems := d.Check(pkg, positions); len(problems) != 0 {
+			t.Errorf("%s: config doesn't check %v", test.name, problems)
+			continue
+		}
+
+		src, err := generate(d)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !strings.Contains(string(src), "\nfunc Top(") {
+			t.Errorf("%s: no Top generated", test.name)
+		}
+	}
+}
+
+func TestReadConfigUnknownSettings(t *testing.T) {
+	config := `mapper:
+  type: uint32
+  deserialize: auto
+  function: F
+  replicat: 4
+  typewidth: 32
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+  arty: 4
+stages:
+  - knd: map
+`
+	_, _, problems, err := readConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Problem{
+		{"mapper.replicat", Position{5, 13}, "isn't a setting reco.yml knows"},
+		{"mapper.typewidth", Position{6, 14}, "isn't a setting reco.yml knows"},
+		{"reducer.arty", Position{12, 9}, "isn't a setting reco.yml knows"},
+		{"stages[0].knd", Position{14, 10}, "isn't a setting reco.yml knows"},
+	}
+	for i, problem := range want {
+		if i >= len(problems) || problems[i] != problem {
+			t.Errorf("problem %d is %v, want %v", i, problems, problem)
+			break
+		}
+	}
+	// Followed by whatever Validate finds in what's left
+	if len(problems) <= len(want) {
+		t.Errorf("only %d problems found, missing those from Validate", len(problems))
+	}
+}
+
+func TestReadConfigMalformed(t *testing.T) {
+	if _, _, _, err := readConfig([]byte("mapper: [\n")); err == nil {
+		t.Error("no error reading malformed YAML")
+	}
+
+	_, _, problems, err := readConfig([]byte("mapper:\n  replicate: four\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) == 0 || problems[0].Field != "mapper.replicate" || problems[0].Position != (Position{2, 14}) {
+		t.Errorf("got problems %v, want mapper.replicate at 2:14 first", problems)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Position is a 1-based line and column within reco.yml
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Positions maps a dotted field path, such as "mapper.replicate" or
+// "stages[1].function", to where it was written in reco.yml. yaml.v2
+// doesn't expose node positions, so we recover them with a line scanner
+// that understands the block style reco.yml is written in. Fields within
+// flow style mappings and sequences, such as "mapper: {type: uint32}",
+// aren't indexed, so are found at their closest block style parent.
+type Positions map[string]Position
+
+// Lookup finds the position of a field, falling back to its closest
+// enclosing section that was present in the file.
+func (p Positions) Lookup(field string) Position {
+	for field != "" {
+		if pos, ok := p[field]; ok {
+			return pos
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			break
+		}
+		field = field[:i]
+	}
+	return Position{Line: 1, Column: 1}
+}
+
+// FieldAt finds the field written on a line, preferring key if it's there,
+// and otherwise the most deeply nested one
+func (p Positions) FieldAt(line int, key string) string {
+	ret := ""
+	for field, pos := range p {
+		if pos.Line != line {
+			continue
+		}
+		if key != "" && (field == key || strings.HasSuffix(field, "."+key)) {
+			return field
+		}
+		if len(field) > len(ret) || len(field) == len(ret) && field < ret {
+			ret = field
+		}
+	}
+	return ret
+}
+
+type positionFrame struct {
+	indent int
+	path   string
+	item   bool
+}
+
+func indexPositions(src []byte) Positions {
+	ret := Positions{}
+	items := map[string]int{}
+	stack := []positionFrame{}
+
+	// The indentation of a key whose value is a block scalar, which
+	// runs on for as long as its lines are indented further
+	block := -1
+
+	for n, line := range strings.Split(string(src), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		indent := len(line) - len(trimmed)
+		if block >= 0 {
+			if trimmed == "" || indent > block {
+				continue
+			}
+			block = -1
+		}
+		if trimmed == "" || trimmed[0] == '#' || strings.HasPrefix(trimmed, "---") {
+			continue
+		}
+		dash := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+
+		// A sequence may sit at the same indentation as its key, so
+		// only items pop their siblings at equal indentation
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.indent < indent || (dash && top.indent == indent && !top.item) {
+				break
+			}
+			stack = stack[:len(stack)-1]
+		}
+
+		parent := ""
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1].path
+		}
+
+		if dash {
+			index := items[parent]
+			items[parent] = index + 1
+			parent = fmt.Sprintf("%s[%d]", parent, index)
+			ret[parent] = Position{Line: n + 1, Column: indent + 1}
+			stack = append(stack, positionFrame{indent: indent, path: parent, item: true})
+
+			rest := strings.TrimLeft(trimmed[1:], " ")
+			indent += len(trimmed) - len(rest)
+			trimmed = rest
+		}
+
+		colon := strings.Index(trimmed, ":")
+		for colon >= 0 && colon+1 < len(trimmed) && trimmed[colon+1] != ' ' {
+			next := strings.Index(trimmed[colon+1:], ":")
+			if next < 0 {
+				colon = -1
+				break
+			}
+			colon += next + 1
+		}
+		if colon <= 0 {
+			continue
+		}
+
+		key := strings.Trim(trimmed[:colon], `"' `)
+		path := key
+		if parent != "" {
+			path = parent + "." + key
+		}
+
+		value := trimmed[colon+1:]
+		valueStart := len(value) - len(strings.TrimLeft(value, " "))
+		if strings.TrimSpace(value) == "" || value[valueStart] == '#' {
+			ret[path] = Position{Line: n + 1, Column: indent + 1}
+		} else {
+			ret[path] = Position{Line: n + 1, Column: indent + colon + 2 + valueStart}
+			if value[valueStart] == '|' || value[valueStart] == '>' {
+				block = indent
+			}
+		}
+		stack = append(stack, positionFrame{indent: indent, path: path})
+	}
+	return ret
+}
@@ -0,0 +1,123 @@
+package main
+
+import "testing"
+
+func TestIndexPositions(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want map[string]Position
+	}{
+		{
+			name: "nested keys",
+			src:  "mapper:\n  type: uint32\n  replicate: 4\nreducer:\n  function: Add\n",
+			want: map[string]Position{
+				"mapper":           {1, 1},
+				"mapper.type":      {2, 9},
+				"mapper.replicate": {3, 14},
+				"reducer":          {4, 1},
+				"reducer.function": {5, 13},
+			},
+		},
+		{
+			name: "items at the key's indent",
+			src:  "stages:\n- kind: map\n  function: F\n- kind: reduce\n  empty: Zero\nparams:\n- name: k\n",
+			want: map[string]Position{
+				"stages":             {1, 1},
+				"stages[0]":          {2, 1},
+				"stages[0].kind":     {2, 9},
+				"stages[0].function": {3, 13},
+				"stages[1]":          {4, 1},
+				"stages[1].kind":     {4, 9},
+				"stages[1].empty":    {5, 10},
+				"params":             {6, 1},
+				"params[0]":          {7, 1},
+				"params[0].name":     {7, 9},
+			},
+		},
+		{
+			name: "indented items",
+			src:  "inputs:\n  - name: a\n    type: uint32\n  -\n    name: b\n",
+			want: map[string]Position{
+				"inputs":         {1, 1},
+				"inputs[0]":      {2, 3},
+				"inputs[0].name": {2, 11},
+				"inputs[0].type": {3, 11},
+				"inputs[1]":      {4, 3},
+				"inputs[1].name": {5, 11},
+			},
+		},
+		{
+			name: "comments",
+			src:  "# A config\nmapper: # the mapper\n  # how many\n  replicate: 4 # lanes\n",
+			want: map[string]Position{
+				"mapper":           {2, 1},
+				"mapper.replicate": {4, 14},
+			},
+		},
+		{
+			name: "quoted keys",
+			src:  "\"mapper\":\n  'function': F\n",
+			want: map[string]Position{
+				"mapper":          {1, 1},
+				"mapper.function": {2, 15},
+			},
+		},
+		{
+			name: "block scalars",
+			src:  "mapper:\n  notes: |\n    type: not a key\n\n    - nor: this\n  type: uint32\nreducer: >\n  depth: 1\n",
+			want: map[string]Position{
+				"mapper":       {1, 1},
+				"mapper.notes": {2, 10},
+				"mapper.type":  {6, 9},
+				"reducer":      {7, 10},
+			},
+		},
+		{
+			name: "colons in values",
+			src:  "mapper:\n  function: pkg:F\n",
+			want: map[string]Position{
+				"mapper":          {1, 1},
+				"mapper.function": {2, 13},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := indexPositions([]byte(test.src))
+		// Nothing else should be taken for a field
+		if len(got) != len(test.want) {
+			t.Errorf("%s: indexed %v", test.name, got)
+		}
+		for field, want := range test.want {
+			if pos, ok := got[field]; !ok {
+				t.Errorf("%s: %s missing", test.name, field)
+			} else if pos != want {
+				t.Errorf("%s: %s at %s, want %s", test.name, field, pos, want)
+			}
+		}
+	}
+}
+
+func TestPositionsLookup(t *testing.T) {
+	positions := indexPositions([]byte("mapper: {type: uint32}\nstages:\n  - kind: map\n"))
+
+	tests := []struct {
+		field string
+		want  Position
+	}{
+		// Flow mappings aren't scanned, so fields in them fall back to
+		// the value of their parent
+		{"mapper.type", Position{1, 9}},
+		{"stages[0].kind", Position{3, 11}},
+		{"stages[0].function", Position{3, 3}},
+		{"stages[3].function", Position{2, 1}},
+		{"reducer.function", Position{1, 1}},
+	}
+
+	for _, test := range tests {
+		if got := positions.Lookup(test.field); got != test.want {
+			t.Errorf("Lookup(%q) = %s, want %s", test.field, got, test.want)
+		}
+	}
+}
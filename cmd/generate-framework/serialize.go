@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+	"strings"
+)
+
+// Auto can be given in place of a serialize or deserialize function, to
+// have one generated from the type
+const Auto = "auto"
+
+// serializers generates (de)serializers for types in the user package,
+// using the same layout as Width: each scalar padded out to whole 32 bit
+// words, in field order, with the low word of 64 bit values first.
+type serializers struct {
+	pkg    *UserPackage
+	names  map[string]bool
+	Source []string
+}
+
+func newSerializers(pkg *UserPackage) *serializers {
+	return &serializers{pkg: pkg, names: map[string]bool{}}
+}
+
+func (s *serializers) typeString(t types.Type) string {
+	return types.TypeString(t, s.pkg.qualifier)
+}
+
+// funcName derives an identifier for a generated function from its type,
+// e.g. autoDeserializeParam or autoSerialize_4_uint32
+func (s *serializers) funcName(prefix string, t types.Type) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s.typeString(t))
+	if name[0] != '_' && strings.ToUpper(name[:1]) != name[:1] {
+		name = "_" + name
+	}
+	return prefix + name
+}
+
+// Deserializer generates func(<-chan uint32, chan<- t), returning its name
+func (s *serializers) Deserializer(t types.Type) (string, error) {
+	name := s.funcName("autoDeserialize", t)
+	if s.names[name] {
+		return name, nil
+	}
+
+	var body bytes.Buffer
+	if err := s.deserialize(&body, "v", t, 0); err != nil {
+		return "", err
+	}
+
+	s.names[name] = true
+	s.Source = append(s.Source, fmt.Sprintf(`
+// %s is generated from %s, reading each field from 32 bit words in order
+func %s(inputChan <-chan uint32, outputChan chan<- %s) {
+	for {
+		var v %s
+		%s
+		outputChan <- v
+	}
+}
+`, name, s.typeString(t), name, s.typeString(t), s.typeString(t), body.String()))
+	return name, nil
+}
+
+// Serializer generates func(<-chan t, chan<- uint32), returning its name
+func (s *serializers) Serializer(t types.Type) (string, error) {
+	name := s.funcName("autoSerialize", t)
+	if s.names[name] {
+		return name, nil
+	}
+
+	var body bytes.Buffer
+	if err := s.serialize(&body, "v", t, 0); err != nil {
+		return "", err
+	}
+
+	s.names[name] = true
+	s.Source = append(s.Source, fmt.Sprintf(`
+// %s is generated from %s, writing each field as 32 bit words in order
+func %s(inputChan <-chan %s, outputChan chan<- uint32) {
+	for {
+		v := <-inputChan
+		%s
+	}
+}
+`, name, s.typeString(t), name, s.typeString(t), body.String()))
+	return name, nil
+}
+
+// accessible checks whether generated code in the user package can set
+// and read every field of a struct
+func (s *serializers) accessible(st *types.Struct, t types.Type) error {
+	for i := 0; i < st.NumFields(); i++ {
+		field := st.Field(i)
+		if field.Name() == "_" {
+			return fmt.Errorf("%s has a blank field, which can't be serialized", s.typeString(t))
+		}
+		if !field.Exported() && field.Pkg() != s.pkg.pkg {
+			return fmt.Errorf("field %s of %s isn't accessible from package %s", field.Name(), s.typeString(t), s.pkg.pkg.Name())
+		}
+	}
+	return nil
+}
+
+func (s *serializers) deserialize(buf *bytes.Buffer, target string, t types.Type, depth int) error {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch u.Kind() {
+		case types.Bool:
+			fmt.Fprintf(buf, "%s = %s(<-inputChan != 0)\n", target, s.typeString(t))
+			return nil
+		case types.Int8, types.Int16, types.Int32, types.Uint8, types.Uint16, types.Uint32:
+			fmt.Fprintf(buf, "%s = %s(<-inputChan)\n", target, s.typeString(t))
+			return nil
+		case types.Int64, types.Uint64:
+			fmt.Fprintf(buf, "{\nlo := <-inputChan\nhi := <-inputChan\n%s = %s(uint64(lo) | uint64(hi)<<32)\n}\n", target, s.typeString(t))
+			return nil
+		}
+	case *types.Array:
+		i := fmt.Sprintf("i%d", depth)
+		fmt.Fprintf(buf, "for %s := 0; %s < %d; %s++ {\n", i, i, u.Len(), i)
+		if err := s.deserialize(buf, fmt.Sprintf("%s[%s]", target, i), u.Elem(), depth+1); err != nil {
+			return err
+		}
+		buf.WriteString("}\n")
+		return nil
+	case *types.Struct:
+		if err := s.accessible(u, t); err != nil {
+			return err
+		}
+		for i := 0; i < u.NumFields(); i++ {
+			if err := s.deserialize(buf, target+"."+u.Field(i).Name(), u.Field(i).Type(), depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("can't deserialize %s", s.typeString(t))
+}
+
+func (s *serializers) serialize(buf *bytes.Buffer, source string, t types.Type, depth int) error {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch u.Kind() {
+		case types.Bool:
+			fmt.Fprintf(buf, "if %s {\noutputChan <- 1\n} else {\noutputChan <- 0\n}\n", source)
+			return nil
+		case types.Int8, types.Int16, types.Int32, types.Uint8, types.Uint16, types.Uint32:
+			fmt.Fprintf(buf, "outputChan <- uint32(%s)\n", source)
+			return nil
+		case types.Int64, types.Uint64:
+			fmt.Fprintf(buf, "outputChan <- uint32(%s)\noutputChan <- uint32(uint64(%s) >> 32)\n", source, source)
+			return nil
+		}
+	case *types.Array:
+		i := fmt.Sprintf("i%d", depth)
+		fmt.Fprintf(buf, "for %s := 0; %s < %d; %s++ {\n", i, i, u.Len(), i)
+		if err := s.serialize(buf, fmt.Sprintf("%s[%s]", source, i), u.Elem(), depth+1); err != nil {
+			return err
+		}
+		buf.WriteString("}\n")
+		return nil
+	case *types.Struct:
+		if err := s.accessible(u, t); err != nil {
+			return err
+		}
+		for i := 0; i < u.NumFields(); i++ {
+			if err := s.serialize(buf, source+"."+u.Field(i).Name(), u.Field(i).Type(), depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("can't serialize %s", s.typeString(t))
+}
+
+// Deserializer checks or generates the deserializer named by field,
+// returning the name the generated code should call
+func (c *typeChecker) Deserializer(field string, name string, t types.Type) string {
+	if name != Auto {
+		c.Func(field, name, Signature{
+			Params: []types.Type{recv(types.Typ[types.Uint32]), send(t)},
+		})
+		return name
+	}
+	if t == nil {
+		return name
+	}
+	generated, err := c.auto.Deserializer(t)
+	if err != nil {
+		c.report(field, "%s", err)
+	}
+	return generated
+}
+
+// Serializer checks or generates the serializer named by field,
+// returning the name the generated code should call
+func (c *typeChecker) Serializer(field string, name string, t types.Type) string {
+	if name != Auto {
+		c.Func(field, name, Signature{
+			Params: []types.Type{recv(t), send(types.Typ[types.Uint32])},
+		})
+		return name
+	}
+	if t == nil {
+		return name
+	}
+	generated, err := c.auto.Serializer(t)
+	if err != nil {
+		c.report(field, "%s", err)
+	}
+	return generated
+}
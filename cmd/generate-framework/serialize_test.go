@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"go/types"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func loadSerializers(t *testing.T) (*UserPackage, *serializers) {
+	pkg, err := LoadPackage("testdata/serialize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg, newSerializers(pkg)
+}
+
+func lookupType(t *testing.T, pkg *UserPackage, expr string) types.Type {
+	typ, err := pkg.LookupType(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return typ
+}
+
+// words counts the words a generated body moves through the chan matching
+// op, multiplying out the loops around them
+func words(body string, op string) int {
+	total := 0
+	loops := []int{1}
+	for _, line := range strings.Split(body, "\n") {
+		switch {
+		case strings.HasPrefix(line, "for "):
+			// for iN := 0; iN < K; iN++ {
+			fields := strings.Fields(line)
+			k, _ := strconv.Atoi(strings.TrimSuffix(fields[6], ";"))
+			loops = append(loops, loops[len(loops)-1]*k)
+		case line == "{" || strings.HasSuffix(line, " {") && !strings.HasPrefix(line, "}"):
+			loops = append(loops, loops[len(loops)-1])
+		case line == "}":
+			loops = loops[:len(loops)-1]
+		case strings.Contains(line, op):
+			total += loops[len(loops)-1]
+		}
+	}
+	return total
+}
+
+func TestDeserialize(t *testing.T) {
+	pkg, s := loadSerializers(t)
+
+	var body bytes.Buffer
+	if err := s.deserialize(&body, "v", lookupType(t, pkg, "Record"), 0); err != nil {
+		t.Fatal(err)
+	}
+	want := `v.Small = int8(<-inputChan)
+{
+lo := <-inputChan
+hi := <-inputChan
+v.Big = uint64(uint64(lo) | uint64(hi)<<32)
+}
+v.Ok = bool(<-inputChan != 0)
+for i0 := 0; i0 < 2; i0++ {
+for i1 := 0; i1 < 3; i1++ {
+v.Grid[i0][i1] = uint32(<-inputChan)
+}
+}
+v.Inner.Flag = bool(<-inputChan != 0)
+v.Inner.Fix = Int26_6(<-inputChan)
+v.Fix = Int26_6(<-inputChan)
+`
+	if body.String() != want {
+		t.Errorf("deserialize Record:\n%s\nwant:\n%s", body.String(), want)
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	pkg, s := loadSerializers(t)
+
+	var body bytes.Buffer
+	if err := s.serialize(&body, "v", lookupType(t, pkg, "Record"), 0); err != nil {
+		t.Fatal(err)
+	}
+	want := `outputChan <- uint32(v.Small)
+outputChan <- uint32(v.Big)
+outputChan <- uint32(uint64(v.Big) >> 32)
+if v.Ok {
+outputChan <- 1
+} else {
+outputChan <- 0
+}
+for i0 := 0; i0 < 2; i0++ {
+for i1 := 0; i1 < 3; i1++ {
+outputChan <- uint32(v.Grid[i0][i1])
+}
+}
+if v.Inner.Flag {
+outputChan <- 1
+} else {
+outputChan <- 0
+}
+outputChan <- uint32(v.Inner.Fix)
+outputChan <- uint32(v.Fix)
+`
+	if body.String() != want {
+		t.Errorf("serialize Record:\n%s\nwant:\n%s", body.String(), want)
+	}
+}
+
+// Serializers and deserializers have to agree with Width, or Top reads
+// the wrong number of words for each element
+func TestSerializeWidth(t *testing.T) {
+	pkg, s := loadSerializers(t)
+
+	for _, expr := range []string{"Record", "Inner", "Int26_6", "uint64", "[2][3]uint32", "[4]Inner"} {
+		typ := lookupType(t, pkg, expr)
+		width, err := Width(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var in, out bytes.Buffer
+		if err := s.deserialize(&in, "v", typ, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.serialize(&out, "v", typ, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := words(in.String(), "<-inputChan"); got != width/32 {
+			t.Errorf("deserialize %s reads %d words, but it's %d bits wide", expr, got, width)
+		}
+		// A bool writes one of its two branches, so only count the first
+		written := strings.Replace(out.String(), "outputChan <- 0", "", -1)
+		if got := words(written, "outputChan <-"); got != width/32 {
+			t.Errorf("serialize %s writes %d words, but it's %d bits wide", expr, got, width)
+		}
+	}
+}
+
+func TestSerializerNames(t *testing.T) {
+	pkg, s := loadSerializers(t)
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"Record", "autoDeserializeRecord"},
+		{"uint32", "autoDeserialize_uint32"},
+		{"[2][3]uint32", "autoDeserialize_2__3_uint32"},
+	}
+	for _, test := range tests {
+		typ := lookupType(t, pkg, test.expr)
+		name, err := s.Deserializer(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != test.want {
+			t.Errorf("deserializer for %s is %s, want %s", test.expr, name, test.want)
+		}
+	}
+
+	// Each function is only generated once
+	before := len(s.Source)
+	if _, err := s.Deserializer(lookupType(t, pkg, "Record")); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Source) != before {
+		t.Errorf("deserializer for Record generated twice")
+	}
+}
+
+func TestSerializeErrors(t *testing.T) {
+	pkg, s := loadSerializers(t)
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"Padded", "Padded has a blank field, which can't be serialized"},
+		{"Stamped", "field wall of time.Time isn't accessible from package main"},
+		{"Named", "can't deserialize string"},
+	}
+	for _, test := range tests {
+		_, err := s.Deserializer(lookupType(t, pkg, test.expr))
+		if err == nil || err.Error() != test.want {
+			t.Errorf("deserializer for %s: got error %v, want %s", test.expr, err, test.want)
+		}
+		_, err = s.Serializer(lookupType(t, pkg, test.expr))
+		if want := strings.Replace(test.want, "deserialize", "serialize", 1); err == nil || err.Error() != want {
+			t.Errorf("serializer for %s: got error %v, want %s", test.expr, err, want)
+		}
+	}
+}
@@ -0,0 +1,832 @@
+package main
+
+// Read each input in blocks of ZipBlock elements, zipping together an
+// element of each. Every input shares the read channel, so a block is
+// only requested once there's room to hold all of it, and one input
+// waiting on another can never hold up the read channel.
+var zip = `
+        {{ range $index, $input := .Inputs }}
+        input{{ $index }}Chan := make(chan uint32, 2 * {{ $.ZipBlock }} * ({{ .TypeWidth }} / 32))
+        input{{ $index }}Room := make(chan bool, 2)
+        input{{ $index }}Room <- true
+        input{{ $index }}Room <- true
+
+        go func() {
+            for offset := uint32(0); offset < length; offset += {{ $.ZipBlock }} {
+                n := length - offset
+                if n > {{ $.ZipBlock }} {
+                    n = {{ $.ZipBlock }}
+                }
+                <-input{{ $index }}Room
+                aximemory.ReadBurstUInt32(
+                        memReadAddr{{ $.ReadPort (printf "Input%d" $index) }}, memReadData{{ $.ReadPort (printf "Input%d" $index) }}, true, {{ .Name }}Data + uintptr(offset * ({{ .TypeWidth }} / 8)), n * ({{ .TypeWidth }} / 32), input{{ $index }}Chan)
+            }
+        }()
+
+        input{{ $index }}Elements := make(chan {{ .Type }}, 1)
+        go {{ .Deserialize }}(input{{ $index }}Chan, input{{ $index }}Elements)
+        {{ end }}
+
+        elementChan := make(chan zipElement, 1)
+        go func() {
+            block := uint8(0)
+            for {
+                elementChan <- zipElement{
+                    {{ range $index, $input := .Inputs }}
+                    {{ .Name }}: <-input{{ $index }}Elements,
+                    {{ end }}
+                }
+
+                // Make room for another block of each input
+                block++
+                if block == {{ .ZipBlock }} {
+                    block = 0
+                    {{ range $index, $input := .Inputs }}
+                    input{{ $index }}Room <- true
+                    {{ end }}
+                }
+            }
+        }()
+`
+
+// Make every element on chip, rather than reading each from memory:
+// either by calling the source function with each index, or by reading
+// a single element and handing it out length times
+var source = `
+        elementChan := make(chan {{ .Mapper.Type }}, 1)
+
+        {{ if .Source.Function }}
+        go func() {
+            for i := uint32(0); i < length; i++ {
+                elementChan <- {{ .Source.Function }}(i)
+            }
+        }()
+        {{ else }}
+        inputChan := make(chan uint32, 1)
+        go aximemory.ReadBurstUInt32(
+                memReadAddr{{ .ReadPort "Data" }}, memReadData{{ .ReadPort "Data" }}, true, inputData, {{ .Mapper.TypeWidth }} / 32, inputChan)
+
+        broadcastChan := make(chan {{ .Mapper.Type }}, 1)
+        go {{ .Mapper.Deserialize }}(inputChan, broadcastChan)
+
+        go func() {
+            el := <-broadcastChan
+            for i := uint32(0); i < length; i++ {
+                elementChan <- el
+            }
+        }()
+        {{ end }}
+`
+
+// Each mapper lane takes every Replicate'th element, starting from its
+// index, so knows the index of each element from how many are left. Past
+// the end of the input, and for elements rejected by the filter, a lane
+// contributes the reducer's identity instead, or padding to be dropped
+// when there's no reducer. Mapper outputs are lifted into
+// the reducer's type as they leave the lane. A flat mapper runs alongside
+// its lane, which takes outputs from it until it returns.
+var lanes = `
+        {{ range $index, $spec := .Mappers }}
+        c{{ $spec.Index }} := make(chan {{ $.LaneType }}, 1)
+        {{ if eq $.Mode "keyed" }}
+        k{{ $spec.Index }} := make(chan uint32, 1)
+        {{ end }}
+        {{ if $.KeepFlags }}
+        v{{ $spec.Index }} := make(chan bool, 1)
+        {{ end }}
+
+        {{ if $.Mapper.FlatMap }}
+        {{ if eq $.Mode "map" }}
+        cMore{{ $spec.Index }} := make(chan bool, 1)
+        {{ end }}
+        flatIn{{ $spec.Index }} := make(chan {{ $.ElementType }}, 1)
+        {{ if $.Mapper.Indexed }}
+        flatIndex{{ $spec.Index }} := make(chan uint32, 1)
+        {{ end }}
+        // Unbuffered, so every output has been taken once the mapper
+        // returns and the end is marked
+        flat{{ $spec.Index }} := make(chan {{ $.OutputType }})
+        flatEnd{{ $spec.Index }} := make(chan bool)
+
+        go func() {
+            for {
+                el := <-flatIn{{ $spec.Index }}
+                {{ if $.Mapper.Indexed }}
+                index := <-flatIndex{{ $spec.Index }}
+                {{ end }}
+                {{ $.Mapper.Function }}({{ $.MapperArgs $spec.Index }}, flat{{ $spec.Index }})
+                flatEnd{{ $spec.Index }} <- false
+            }
+        }()
+        {{ end }}
+
+        go func() {
+            {{ if eq $.Mode "histogram" }}
+            // Count into this lane's bins, sent once the input is done
+            var bins {{ $.LaneType }}
+            {{ else if $.Mapper.LocalFold }}
+            // Fold this lane's outputs, sent once the input is done
+            acc := {{ $.Reducer.Empty }}()
+            {{ end }}
+
+            for n := elements; n != 0; {
+                el := <-data{{ $spec.Index }}
+                keep := n > {{ $spec.Index }}{{ if $.Mapper.Filter }} && {{ $.Mapper.Filter }}({{ $.ElementArgs }}){{ end }}
+                {{ if $.Mapper.Indexed }}
+                // Each round starts at the element elements - n
+                index := elements - n + {{ $spec.Index }}
+                {{ with $.Mapper.Window }}
+                // Windows are indexed by their first element in the input
+                index *= {{ .Steps }}
+                {{ end }}
+                {{ end }}
+
+                {{ if $.Mapper.FlatMap }}
+                if keep {
+                    flatIn{{ $spec.Index }} <- el
+                    {{ if $.Mapper.Indexed }}
+                    flatIndex{{ $spec.Index }} <- index
+                    {{ end }}
+                }
+                {{ if and (eq $.Mode "reduce") (not $.Mapper.LocalFold) }}
+                acc := {{ $.Reducer.Empty }}()
+                {{ end }}
+                // Take each of the mapper's outputs, until it marks the end
+                for more := keep; more; {
+                    select {
+                    case out := <-flat{{ $spec.Index }}:
+                        {{ if eq $.Mode "histogram" }}
+                        if out < {{ $.Histogram.Bins }} {
+                            bins[out]++
+                        }
+                        {{ else if eq $.Mode "map" }}
+                        cMore{{ $spec.Index }} <- true
+                        c{{ $spec.Index }} <- out
+                        {{ else }}
+                        acc = {{ $.Fold "acc" ($.Lift "out") }}
+                        {{ end }}
+                    case more = <-flatEnd{{ $spec.Index }}:
+                    }
+                }
+                {{ if eq $.Mode "map" }}
+                cMore{{ $spec.Index }} <- false
+                {{ else if and (eq $.Mode "reduce") (not $.Mapper.LocalFold) }}
+                c{{ $spec.Index }} <- acc
+                {{ end }}
+                {{ else if eq $.Mode "histogram" }}
+                if keep {
+                    bin := {{ $.Mapper.Function }}({{ $.MapperArgs $spec.Index }})
+                    if bin < {{ $.Histogram.Bins }} {
+                        bins[bin]++
+                    }
+                }
+                {{ else if eq $.Mode "keyed" }}
+                if keep {
+                    key, value := {{ $.Mapper.Function }}({{ $.MapperArgs $spec.Index }})
+                    k{{ $spec.Index }} <- key
+                    c{{ $spec.Index }} <- {{ $.Lift "value" }}
+                } else {
+                    k{{ $spec.Index }} <- 0
+                    c{{ $spec.Index }} <- {{ $.Reducer.Empty }}()
+                }
+                {{ else if $.Mapper.LocalFold }}
+                if keep {
+                    out := {{ $.Mapper.Function }}({{ $.MapperArgs $spec.Index }})
+                    acc = {{ $.Fold "acc" ($.Lift "out") }}
+                }
+                {{ else }}
+                if keep {
+                    out := {{ $.Mapper.Function }}({{ $.MapperArgs $spec.Index }})
+                    c{{ $spec.Index }} <- {{ $.Lift "out" }}
+                } else {
+                {{ if $.Reducer }}
+                    c{{ $spec.Index }} <- {{ $.Reducer.Empty }}()
+                {{ else }}
+                    c{{ $spec.Index }} <- [1]{{ $.LaneType }}{}[0]
+                {{ end }}
+                }
+                {{ end }}
+
+                {{ if $.KeepFlags }}
+                v{{ $spec.Index }} <- keep
+                {{ end }}
+
+                if n < {{ $.Mapper.Replicate }} {
+                   n = 0
+                } else {
+                  n -= {{ $.Mapper.Replicate }}
+                }
+            }
+
+            {{ if eq $.Mode "histogram" }}
+            c{{ $spec.Index }} <- bins
+            {{ else if $.Mapper.LocalFold }}
+            c{{ $spec.Index }} <- acc
+            {{ end }}
+        }()
+        {{ end }}
+`
+
+// Reduce every mapper output to a single value, written back to outputData
+var reduce = `
+                // Reducer part
+                {{ range $index, $element := .Reducers }}
+                {{ range $index, $spec := $element }}
+                    c{{ $spec.OutputIndex }} := make(chan {{ $.Reducer.Type }}, 1)
+                 	go func() {
+			for{
+                        {{ if $.Reducer.Nary }}
+                        c{{ $spec.OutputIndex }} <- {{ $.Reducer.Function }}([{{ $.Reducer.Fanin }}]{{ $.Reducer.Type }}{
+                            {{ range $spec.Inputs }}{{ if lt . 0 }}{{ $.Reducer.Empty }}(){{ else }}<-c{{ . }}{{ end }},
+                            {{ end }}
+                        })
+                        {{ else }}
+         	        	c{{ $spec.OutputIndex }} <- {{ $.Reducer.Function }}(<-c{{ index $spec.Inputs 0 }}, <-c{{ index $spec.Inputs 1 }})
+                        {{ end }}
+			}
+                 	}()
+                     {{ end }}
+                     {{ end }}
+
+        retChan := make(chan {{ .Reducer.Type }})
+        outputDataChan := make(chan uint32)
+
+        go func(){
+            var ret {{ .Reducer.Type }}
+            ret = {{ .Reducer.Empty }}()
+            {{ if .Mapper.LocalFold }}
+            // Each lane sends a single output, so the tree only runs once
+            {{ template "accumulate" . }}
+            {{ else }}
+            toRead := uint32({{ .Mapper.Replicate }})
+            for n := elements; n > 0; n -= toRead {
+                if n < toRead {
+                   toRead = n
+                }
+                {{ template "accumulate" . }}
+            }
+            {{ end }}
+            retChan <- ret
+        }()
+
+        go {{ .Reducer.Serialize }}(retChan, outputDataChan)
+
+        // Write it back to the pointer the host requests
+        aximemory.WriteBurstUInt32(
+                memWriteAddr, memWriteData, memWriteResp, true, outputData, {{ .Reducer.TypeWidth }} / 32, outputDataChan)
+`
+
+// Fold every output left by the reducer tree into ret
+var accumulate = `
+                {{ range .Accumulate }}
+                {{ if $.Reducer.Nary }}
+                ret = {{ $.Reducer.Function }}([{{ $.Reducer.Fanin }}]{{ $.Reducer.Type }}{
+                    ret,
+                    {{ range . }}{{ if lt . 0 }}{{ $.Reducer.Empty }}(){{ else }}<-c{{ . }}{{ end }},
+                    {{ end }}
+                })
+                {{ else }}
+                ret = {{ $.Reducer.Function }}(ret, <-c{{ index . 0 }})
+                {{ end }}
+                {{ end }}
+`
+
+// Without a reducer, every mapper output is written back to outputData
+// in the order its input was read
+var mapOnly = `
+        {{ if .Mapper.FlatMap }}
+        {{ template "gatherFlat" (.Tree "gather" "c" .LaneType) }}
+        {{ else }}
+        {{ template "gather" (.Tree "gather" "c" .LaneType) }}
+        {{ end }}
+        {{ if .KeepFlags }}
+        {{ template "gather" (.Tree "gatherKeep" "v" "bool") }}
+        {{ end }}
+
+        resultChan := make(chan {{ .LaneType }}, 1)
+        outputDataChan := make(chan uint32)
+        {{ if .Compact }}
+        keptChan := make(chan bool)
+        {{ end }}
+
+        // Collect results in order, dropping the padding past the end
+        go func() {
+            for n := elements; n != 0; {
+                for i := {{ .CounterType }}(0); i < {{ .Mapper.Replicate }}; i++ {
+                    {{ if .Mapper.FlatMap }}
+                    for <-gatherMore0 {
+                        resultChan <- <-gather0
+                        keptChan <- true
+                    }
+                    {{ else }}
+                    el := <-gather0
+                    {{ if .Compact }}
+                    if <-gatherKeep0 {
+                        resultChan <- el
+                        keptChan <- true
+                    }
+                    {{ else }}
+                    if uint32(i) < n {
+                        resultChan <- el
+                    }
+                    {{ end }}
+                    {{ end }}
+                }
+
+                if n < {{ .Mapper.Replicate }} {
+                   n = 0
+                }else {
+                  n -= {{ .Mapper.Replicate }}
+                }
+            }
+            {{ if .Compact }}
+            keptChan <- false
+            {{ end }}
+        }()
+
+        go {{ .Mapper.Serialize }}(resultChan, outputDataChan)
+
+        {{ if .Compact }}
+        {{ template "compact" (.CompactWriter .Mapper.OutputWidth) }}
+        {{ else }}
+        // Write them back to the pointer the host requests
+        aximemory.WriteBurstUInt32(
+                memWriteAddr, memWriteData, memWriteResp, true, outputData, elements * ({{ .Mapper.OutputWidth }} / 32), outputDataChan)
+        {{ end }}
+`
+
+// With keys, each mapper output is reduced into an accumulator for its
+// key, and the whole table is written back to outputData in key order
+var keyed = `
+        {{ template "gather" (.Tree "gatherKey" "k" "uint32") }}
+        {{ template "gather" (.Tree "gather" "c" .LaneType) }}
+
+        retChan := make(chan {{ .Reducer.Type }}, 1)
+        outputDataChan := make(chan uint32)
+
+        go func() {
+            var table [{{ .Reducer.Keys }}]{{ .Reducer.Type }}
+            for key := 0; key < {{ .Reducer.Keys }}; key++ {
+                table[key] = {{ .Reducer.Empty }}()
+            }
+
+            for n := elements; n != 0; {
+                for i := {{ .CounterType }}(0); i < {{ .Mapper.Replicate }}; i++ {
+                    key := <-gatherKey0
+                    value := <-gather0
+                    // Drop padding, and keys outside of the table
+                    if uint32(i) < n && key < {{ .Reducer.Keys }} {
+                        {{ if .Reducer.Nary }}
+                        table[key] = {{ .Reducer.Function }}([{{ .Reducer.Fanin }}]{{ .Reducer.Type }}{
+                            table[key],
+                            value,
+                            {{ range .Reducer.Empties 2 }}{{ $.Reducer.Empty }}(),
+                            {{ end }}
+                        })
+                        {{ else }}
+                        table[key] = {{ .Reducer.Function }}(table[key], value)
+                        {{ end }}
+                    }
+                }
+
+                if n < {{ .Mapper.Replicate }} {
+                   n = 0
+                }else {
+                  n -= {{ .Mapper.Replicate }}
+                }
+            }
+
+            for key := 0; key < {{ .Reducer.Keys }}; key++ {
+                retChan <- table[key]
+            }
+        }()
+
+        go {{ .Reducer.Serialize }}(retChan, outputDataChan)
+
+        // Write the table back to the pointer the host requests
+        aximemory.WriteBurstUInt32(
+                memWriteAddr, memWriteData, memWriteResp, true, outputData, {{ .Reducer.Keys }} * ({{ .Reducer.TypeWidth }} / 32), outputDataChan)
+`
+
+// Merge the bins counted by each mapper through a tree of adders, and
+// write the totals back to outputData
+var histogram = `
+        {{ range $index, $element := .Adders }}
+        {{ range $index, $spec := $element }}
+        c{{ $spec.OutputIndex }} := make(chan {{ $.LaneType }}, 1)
+        go func() {
+            a := <-c{{ index $spec.Inputs 0 }}
+            b := <-c{{ index $spec.Inputs 1 }}
+            var sum {{ $.LaneType }}
+            for i := 0; i < {{ $.Histogram.Bins }}; i++ {
+                sum[i] = a[i] + b[i]
+            }
+            c{{ $spec.OutputIndex }} <- sum
+        }()
+        {{ end }}
+        {{ end }}
+
+        outputDataChan := make(chan uint32)
+
+        go func() {
+            bins := <-c{{ .AdderOutput }}
+            for i := 0; i < {{ .Histogram.Bins }}; i++ {
+                outputDataChan <- bins[i]
+            }
+        }()
+
+        // Write the bins back to the pointer the host requests
+        aximemory.WriteBurstUInt32(
+                memWriteAddr, memWriteData, memWriteResp, true, outputData, {{ .Histogram.Bins }}, outputDataChan)
+`
+
+// Scan the mapper outputs of each round through a network, then add on
+// the total of every round before, writing back each prefix in order
+var scan = `
+        // Scan network chans
+        {{ range .ScanNodes }}
+        {{ if gt .Level 0 -}}
+        scan{{ .Level }}_{{ .Index }} := make(chan {{ $.Reducer.Type }}, 1)
+        {{ if .Left -}}
+        scanLeft{{ .Level }}_{{ .Index }} := make(chan {{ $.Reducer.Type }}, 1)
+        {{ end }}
+        {{ end }}
+        {{ if .Last -}}
+        scanOut{{ .Index }} := make(chan {{ $.Reducer.Type }}, 1)
+        {{ end }}
+        {{ end }}
+
+        {{ range .ScanNodes }}
+        go func() {
+            for {
+                {{ if eq .Level 0 }}
+                v := <-c{{ .Index }}
+                {{ else if .Left }}
+                v := {{ $.Reducer.Function }}(<-scanLeft{{ .Level }}_{{ .Index }}, <-scan{{ .Level }}_{{ .Index }})
+                {{ else }}
+                v := <-scan{{ .Level }}_{{ .Index }}
+                {{ end }}
+
+                {{ if .Last }}
+                scanOut{{ .Index }} <- v
+                {{ else }}
+                scan{{ .Next }}_{{ .Index }} <- v
+                {{ if ge .Right 0 }}
+                scanLeft{{ .Next }}_{{ .Right }} <- v
+                {{ end }}
+                {{ end }}
+            }
+        }()
+        {{ end }}
+
+        {{ template "gather" (.Tree "gather" "scanOut" .LaneType) }}
+
+        resultChan := make(chan {{ .Reducer.Type }}, 1)
+        outputDataChan := make(chan uint32)
+
+        go func() {
+            // The total of every round before this one
+            carry := {{ .Reducer.Empty }}()
+            {{ if eq .Reducer.Scan "exclusive" }}
+            // The inclusive prefix of the element before this one
+            prev := {{ .Reducer.Empty }}()
+            {{ end }}
+            for n := elements; n != 0; {
+                for i := {{ .CounterType }}(0); i < {{ .Mapper.Replicate }}; i++ {
+                    prefix := {{ .Reducer.Function }}(carry, <-gather0)
+                    // Drop the padding past the end
+                    if uint32(i) < n {
+                        {{ if eq .Reducer.Scan "exclusive" }}
+                        resultChan <- prev
+                        prev = prefix
+                        {{ else }}
+                        resultChan <- prefix
+                        {{ end }}
+                    }
+                    if i == {{ .Mapper.Replicate }} - 1 {
+                        carry = prefix
+                    }
+                }
+
+                if n < {{ .Mapper.Replicate }} {
+                   n = 0
+                }else {
+                  n -= {{ .Mapper.Replicate }}
+                }
+            }
+        }()
+
+        go {{ .Reducer.Serialize }}(resultChan, outputDataChan)
+
+        // Write them back to the pointer the host requests
+        aximemory.WriteBurstUInt32(
+                memWriteAddr, memWriteData, memWriteResp, true, outputData, elements * ({{ .Reducer.TypeWidth }} / 32), outputDataChan)
+`
+
+// Chain stages one after another, each reading the elements of stream<i>
+// and writing stream<i+1>. Once a filter has run, streams carry a flag
+// alongside each element saying whether it was kept, so every stage knows
+// how many elements to expect. Map stages spread elements over their own
+// lanes, and the other stages handle one element at a time.
+var pipeline = `
+        {{ with .FirstStage }}
+        // Read all of the input data into a channel
+        inputChan := make(chan uint32, 1)
+        go aximemory.ReadBurstUInt32(
+                memReadAddr, memReadData, true, inputData, length * ({{ .TypeWidth }} / 32), inputChan)
+
+        stream0 := make(chan {{ .Type }}, 1)
+        go {{ .Deserialize }}(inputChan, stream0)
+        {{ end }}
+
+        {{ range .Pipeline }}
+        // Stage {{ .Index }}: {{ .Kind }} {{ .Function }}
+        stream{{ .Next }} := make(chan {{ .OutputType }}, 1)
+        {{ if .KeptOut }}
+        streamKept{{ .Next }} := make(chan bool, 1)
+        {{ end }}
+
+        {{ if eq .Kind "map" }}
+        {{ $stage := . }}
+        {{ range .Lanes }}
+        stage{{ $stage.Index }}Data{{ .Index }} := make(chan {{ $stage.Type }}, 1)
+        stage{{ $stage.Index }}Valid{{ .Index }} := make(chan bool, 1)
+        stage{{ $stage.Index }}Out{{ .Index }} := make(chan {{ $stage.Output }}, 1)
+        stage{{ $stage.Index }}OutValid{{ .Index }} := make(chan bool, 1)
+        {{ end }}
+
+        {{ template "scatter" (.Tree "Dispatch" "Data" .Type) }}
+        {{ template "scatter" (.Tree "DispatchValid" "Valid" "bool") }}
+
+        // Hand out elements to each lane in turn, padding the last round
+        go func() {
+            for n := uint32({{ .Count }}); n != 0; {
+                for i := {{ .CounterType }}(0); i < {{ .Replicate }}; i++ {
+                    if uint32(i) < n {
+                        stage{{ .Index }}Dispatch0 <- <-stream{{ .Index }}
+                        stage{{ .Index }}DispatchValid0 <- {{ if .Kept }}<-streamKept{{ .Index }}{{ else }}true{{ end }}
+                    } else {
+                        stage{{ .Index }}Dispatch0 <- [1]{{ .Type }}{}[0]
+                        stage{{ .Index }}DispatchValid0 <- false
+                    }
+                }
+
+                if n < {{ .Replicate }} {
+                   n = 0
+                } else {
+                  n -= {{ .Replicate }}
+                }
+            }
+        }()
+
+        {{ range .Lanes }}
+        go func() {
+            for {
+                el := <-stage{{ $stage.Index }}Data{{ .Index }}
+                valid := <-stage{{ $stage.Index }}Valid{{ .Index }}
+                if valid {
+                    stage{{ $stage.Index }}Out{{ .Index }} <- {{ $stage.Function }}(el)
+                } else {
+                    stage{{ $stage.Index }}Out{{ .Index }} <- [1]{{ $stage.Output }}{}[0]
+                }
+                stage{{ $stage.Index }}OutValid{{ .Index }} <- valid
+            }
+        }()
+        {{ end }}
+
+        {{ template "gather" (.Tree "Gather" "Out" .Output) }}
+        {{ template "gather" (.Tree "GatherValid" "OutValid" "bool") }}
+
+        // Collect results in order, dropping the padding past the end
+        go func() {
+            for n := uint32({{ .Count }}); n != 0; {
+                for i := {{ .CounterType }}(0); i < {{ .Replicate }}; i++ {
+                    el := <-stage{{ .Index }}Gather0
+                    {{ if .KeptOut }}
+                    valid := <-stage{{ .Index }}GatherValid0
+                    {{ else }}
+                    <-stage{{ .Index }}GatherValid0
+                    {{ end }}
+                    if uint32(i) < n {
+                        stream{{ .Next }} <- el
+                        {{ if .KeptOut }}
+                        streamKept{{ .Next }} <- valid
+                        {{ end }}
+                    }
+                }
+
+                if n < {{ .Replicate }} {
+                   n = 0
+                } else {
+                  n -= {{ .Replicate }}
+                }
+            }
+        }()
+
+        {{ else if eq .Kind "filter" }}
+        go func() {
+            for n := uint32({{ .Count }}); n != 0; n-- {
+                el := <-stream{{ .Index }}
+                stream{{ .Next }} <- el
+                streamKept{{ .Next }} <- {{ if .Kept }}<-streamKept{{ .Index }} && {{ end }}{{ .Function }}(el)
+            }
+        }()
+
+        {{ else if eq .Kind "reduce" }}
+        go func() {
+            acc := {{ .Empty }}()
+            for n := uint32({{ .Count }}); n != 0; n-- {
+                el := <-stream{{ .Index }}
+                {{ if .Kept }}
+                if <-streamKept{{ .Index }} {
+                    acc = {{ .Function }}(acc, el)
+                }
+                {{ else }}
+                acc = {{ .Function }}(acc, el)
+                {{ end }}
+            }
+            stream{{ .Next }} <- acc
+        }()
+
+        {{ else if eq .Kind "scan" }}
+        go func() {
+            acc := {{ .Empty }}()
+            for n := uint32({{ .Count }}); n != 0; n-- {
+                el := <-stream{{ .Index }}
+                kept := {{ if .Kept }}<-streamKept{{ .Index }}{{ else }}true{{ end }}
+                {{ if eq .Scan "exclusive" }}
+                stream{{ .Next }} <- acc
+                {{ end }}
+                if kept {
+                    acc = {{ .Function }}(acc, el)
+                }
+                {{ if ne .Scan "exclusive" }}
+                stream{{ .Next }} <- acc
+                {{ end }}
+                {{ if .KeptOut }}
+                streamKept{{ .Next }} <- kept
+                {{ end }}
+            }
+        }()
+        {{ end }}
+        {{ end }}
+
+        {{ with .LastStage }}
+        outputDataChan := make(chan uint32)
+
+        {{ if .KeptOut }}
+        resultChan := make(chan {{ .OutputType }}, 1)
+        keptChan := make(chan bool)
+
+        // Pass on only the elements that were kept
+        go func() {
+            for n := uint32({{ .CountOut }}); n != 0; n-- {
+                el := <-stream{{ .Next }}
+                if <-streamKept{{ .Next }} {
+                    resultChan <- el
+                    keptChan <- true
+                }
+            }
+            keptChan <- false
+        }()
+
+        go {{ .Serialize }}(resultChan, outputDataChan)
+
+        {{ template "compact" ($.CompactWriter .OutputWidth) }}
+        {{ else }}
+        go {{ .Serialize }}(stream{{ .Next }}, outputDataChan)
+
+        // Write the results back to the pointer the host requests
+        aximemory.WriteBurstUInt32(
+                memWriteAddr, memWriteData, memWriteResp, true, outputData, {{ .CountOut }} * ({{ .OutputWidth }} / 32), outputDataChan)
+        {{ end }}
+        {{ end }}
+`
+
+// Write the results that were kept back to the pointer the host requests,
+// after a word holding how many there were. Whoever collects the results
+// sends true on keptChan as each one goes to be serialized into
+// outputDataChan, and false once there are no more. Results are buffered
+// a block at a time, so each block is written in a single burst once it's
+// known how many it holds.
+var compact = `
+        compactChan := make(chan uint32, {{ .Block }} * ({{ .Width }} / 32))
+        go func() {
+            for {
+                compactChan <- <-outputDataChan
+            }
+        }()
+
+        kept := uint32(0)
+        offset := outputData + 4
+        for more := true; more; {
+            n := uint32(0)
+            for more && n < {{ .Block }} {
+                more = <-keptChan
+                if more {
+                    n++
+                }
+            }
+            if n != 0 {
+                aximemory.WriteBurstUInt32(
+                        memWriteAddr, memWriteData, memWriteResp, true, offset, n * ({{ .Width }} / 32), compactChan)
+                offset += uintptr(n * ({{ .Width }} / 8))
+                kept += n
+            }
+        }
+
+        keptCountChan := make(chan uint32, 1)
+        keptCountChan <- kept
+        aximemory.WriteBurstUInt32(
+                memWriteAddr, memWriteData, memWriteResp, true, outputData, 1, keptCountChan)
+`
+
+// Gather mapper outputs from the chans Lanes0, Lanes1... into Prefix0
+// in lane order, through a tree mirroring the dispatch tree
+var gather = `
+        {{ range .Nodes -}}
+        {{ $.Prefix }}{{ .Index }} := make(chan {{ $.Type }}, 1)
+        {{ end }}
+
+        {{ range $index, $spec := .Nodes }}
+        go func() {
+            for {
+                {{ range $spec.Children }}
+                {{ if .Lane }}
+                {{ $.Prefix }}{{ $spec.Index }} <- <-{{ $.Lanes }}{{ .Index }}
+                {{ else }}
+                for i := {{ $.CounterType }}(0); i < {{ .Size }}; i++ {
+                    {{ $.Prefix }}{{ $spec.Index }} <- <-{{ $.Prefix }}{{ .Index }}
+                }
+                {{ end }}
+                {{ end }}
+            }
+        }()
+        {{ end }}
+`
+
+// Gather the outputs of flat mappers in lane order. For each element,
+// lanes send a run of outputs, each flagged on LanesMore0, LanesMore1...
+// as following on from the last, and then a false flag to end the run.
+// Each node forwards a whole run from one child before moving on to the
+// next.
+var gatherFlat = `
+        {{ range .Nodes -}}
+        {{ $.Prefix }}{{ .Index }} := make(chan {{ $.Type }}, 1)
+        {{ $.Prefix }}More{{ .Index }} := make(chan bool, 1)
+        {{ end }}
+
+        {{ range $index, $spec := .Nodes }}
+        go func() {
+            for {
+                {{ range $spec.Children }}
+                {{ if .Lane }}
+                for {
+                    more := <-{{ $.Lanes }}More{{ .Index }}
+                    {{ $.Prefix }}More{{ $spec.Index }} <- more
+                    if !more {
+                        break
+                    }
+                    {{ $.Prefix }}{{ $spec.Index }} <- <-{{ $.Lanes }}{{ .Index }}
+                }
+                {{ else }}
+                for i := {{ $.CounterType }}(0); i < {{ .Size }}; i++ {
+                    for {
+                        more := <-{{ $.Prefix }}More{{ .Index }}
+                        {{ $.Prefix }}More{{ $spec.Index }} <- more
+                        if !more {
+                            break
+                        }
+                        {{ $.Prefix }}{{ $spec.Index }} <- <-{{ $.Prefix }}{{ .Index }}
+                    }
+                }
+                {{ end }}
+                {{ end }}
+            }
+        }()
+        {{ end }}
+`
+
+// Scatter elements sent to Prefix0 across the chans Lanes0, Lanes1...
+// in lane order, the reverse of gather
+var scatter = `
+        {{ range .Nodes -}}
+        {{ $.Prefix }}{{ .Index }} := make(chan {{ $.Type }}, 1)
+        {{ end }}
+
+        {{ range $index, $spec := .Nodes }}
+        go func() {
+            for {
+                {{ range $spec.Children }}
+                {{ if .Lane }}
+                {{ $.Lanes }}{{ .Index }} <- <-{{ $.Prefix }}{{ $spec.Index }}
+                {{ else }}
+                for i := {{ $.CounterType }}(0); i < {{ .Size }}; i++ {
+                    {{ $.Prefix }}{{ .Index }} <- <-{{ $.Prefix }}{{ $spec.Index }}
+                }
+                {{ end }}
+                {{ end }}
+            }
+        }()
+        {{ end }}
+`
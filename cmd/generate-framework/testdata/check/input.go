@@ -0,0 +1,41 @@
+package main
+
+type Point struct {
+	X uint32
+	Y uint32
+}
+
+func Norm(p Point) uint32 { return p.X*p.X + p.Y*p.Y }
+
+func Wide(p Point) uint64 { return uint64(p.X) }
+
+func Add(a uint32, b uint32) uint32 { return a + b }
+
+func Zero() uint32 { return 0 }
+
+func ZeroFrom(seed uint32) uint32 { return seed }
+
+func DeserializePoint(input <-chan uint32, output chan<- Point) {
+	for {
+		output <- Point{<-input, <-input}
+	}
+}
+
+func DeserializeWide(input <-chan uint32, output chan<- uint64) {
+	for {
+		output <- uint64(<-input)
+	}
+}
+
+func Noise(seed uint32, output chan<- uint32) {
+	for {
+		seed = seed*1103515245 + 12345
+		output <- seed
+	}
+}
+
+func NoiseWrong(seed uint32, output chan<- uint64) {}
+
+func Jitter(noise <-chan uint32, p Point) uint32 { return p.X + <-noise }
+
+func Small(x uint32) bool { return x < 1024 }
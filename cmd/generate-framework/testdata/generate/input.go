@@ -0,0 +1,66 @@
+package main
+
+type Point struct {
+	X uint32
+	Y uint32
+}
+
+type Seed struct {
+	Seed   uint64
+	Stream uint32
+}
+
+type Stats struct {
+	N     uint32
+	Total uint64
+}
+
+func Norm(p Point) uint32 { return p.X*p.X + p.Y*p.Y }
+
+func Near(p Point) bool { return p.X < 16 }
+
+func Add(a uint32, b uint32) uint32 { return a + b }
+
+func Add4(v [4]uint32) uint32 { return v[0] + v[1] + v[2] + v[3] }
+
+func Zero() uint32 { return 0 }
+
+func Quadrant(p Point) (uint32, uint32) { return p.X >> 31, 1 }
+
+func Bin(p Point) uint32 { return p.X >> 28 }
+
+func Smooth(w [3]Point) Point { return Point{(w[0].X + w[1].X + w[2].X) / 3, w[1].Y} }
+
+func Corners(p Point, out chan<- Point) {
+	out <- p
+	out <- Point{p.Y, p.X}
+}
+
+func Lift(x uint32) Stats { return Stats{1, uint64(x)} }
+
+func Merge(a Stats, b Stats) Stats { return Stats{a.N + b.N, a.Total + b.Total} }
+
+func Empty() Stats { return Stats{} }
+
+func Noise(seed uint32, output chan<- uint32) {
+	for {
+		seed = seed*1103515245 + 12345
+		output <- seed
+	}
+}
+
+func SeededNoise(s Seed, output chan<- uint32) { Noise(uint32(s.Seed)+s.Stream, output) }
+
+func Jitter(noise <-chan uint32, p Point) uint32 { return p.X + <-noise }
+
+func Dot(a Point, b Point) uint32 { return a.X*b.X + a.Y*b.Y }
+
+func Weigh(p Point, index uint32, scale uint32, weights [8]uint32) uint32 {
+	return (p.X + index) * scale * weights[index%8]
+}
+
+func Origin(i uint32) Point { return Point{i, i} }
+
+func Double(x uint32) uint32 { return 2 * x }
+
+func Even(x uint32) bool { return x%2 == 0 }
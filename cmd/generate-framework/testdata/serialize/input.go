@@ -0,0 +1,33 @@
+package main
+
+import "time"
+
+// Int26_6 stands in for fixed.Int26_6
+type Int26_6 int32
+
+type Inner struct {
+	Flag bool
+	Fix  Int26_6
+}
+
+type Record struct {
+	Small int8
+	Big   uint64
+	Ok    bool
+	Grid  [2][3]uint32
+	Inner Inner
+	Fix   Int26_6
+}
+
+type Padded struct {
+	A uint32
+	_ uint32
+}
+
+type Stamped struct {
+	At time.Time
+}
+
+type Named struct {
+	Name string
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Problem is a single reason why a reco.yml can't be turned into a
+// working framework
+type Problem struct {
+	Field    string
+	Position Position
+	Message  string
+}
+
+func (p Problem) Error() string {
+	return fmt.Sprintf("%s: %s: %s", p.Position, p.Field, p.Message)
+}
+
+// validator collects every problem found, rather than stopping at the first
+type validator struct {
+	positions Positions
+	problems  []Problem
+}
+
+func (v *validator) report(field string, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Field:    field,
+		Position: v.positions.Lookup(field),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) required(field string, value string) {
+	if value == "" {
+		v.report(field, "is required")
+	}
+}
+
+// Widths are optional, as they can be inferred from the type
+func (v *validator) typeWidth(field string, width int) {
+	if width < 0 || width%32 != 0 {
+		v.report(field, "must be a positive multiple of 32, got %d", width)
+	}
+}
+
+// logk of n, rounded up. This is the depth of a full reducer tree with
+// fanin k over n mappers.
+func logk(k int, n int) int {
+	ret := 0
+	for width := 1; width < n; width *= k {
+		ret++
+	}
+	return ret
+}
+
+var (
+	yamlError    = regexp.MustCompile(`^line (\d+): (.*)$`)
+	unknownField = regexp.MustCompile(`^field (\S+) not found in type`)
+)
+
+// yamlProblems turns the errors from reading reco.yml into the struct,
+// such as misspelled settings, into problems. Any other error means the
+// file couldn't be read at all, and is returned as it is.
+func yamlProblems(err error, positions Positions) ([]Problem, error) {
+	if err == nil {
+		return nil, nil
+	}
+	terr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil, err
+	}
+
+	ret := []Problem{}
+	for _, e := range terr.Errors {
+		problem := Problem{Position: Position{Line: 1, Column: 1}, Message: e}
+		if m := yamlError.FindStringSubmatch(e); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			problem.Position.Line = line
+			problem.Message = m[2]
+
+			key := ""
+			if unknown := unknownField.FindStringSubmatch(m[2]); unknown != nil {
+				key = unknown[1]
+				problem.Message = "isn't a setting reco.yml knows"
+			}
+			if field := positions.FieldAt(line, key); field != "" {
+				problem.Field = field
+				problem.Position = positions[field]
+			}
+		}
+		ret = append(ret, problem)
+	}
+	return ret, nil
+}
+
+// Validate checks that the config describes a framework we can generate,
+// returning every problem found. Positions are used to point each problem
+// at the offending line of reco.yml.
+func (d Data) Validate(positions Positions) []Problem {
+	v := &validator{positions: positions}
+
+	// A pipeline describes every stage itself
+	if d.Mode() == ModePipeline {
+		d.validatePipeline(v)
+		return v.problems
+	}
+
+	if d.Context != nil {
+		d.Context.validate(v)
+	}
+	d.Mapper.validate(v, len(d.Inputs) != 0, !d.ReadsInput())
+	d.validateInputs(v)
+	if d.Source != nil {
+		d.Source.validate(v, len(d.Inputs) != 0)
+	}
+	d.validateParams(v)
+	d.validateTables(v)
+	if d.Reducer != nil && d.Histogram != nil {
+		v.report("histogram", "can't be used along with a reducer")
+	}
+
+	if d.Mapper.LocalFold && d.Mode() != ModeReduce {
+		v.report("mapper.localFold", "needs a reducer, without keys or scan")
+	}
+
+	// Scans and keyed reduce need exactly one output for each element
+	if d.Mapper.FlatMap && (d.Mode() == ModeKeyed || d.Mode() == ModeScan) {
+		v.report("mapper.flatMap", "can't be used with keyed reduce or scan")
+	}
+
+	switch d.Mode() {
+	case ModeReduce, ModeKeyed, ModeScan:
+		d.Reducer.validate(v, d.Mapper.Replicate)
+		// Without a lift, the mapper has to produce the reducer's type
+		// itself
+		if d.Reducer.Lift != "" {
+			v.required("mapper.output", d.Mapper.Output)
+		} else if d.Mapper.Output != "" && d.Mapper.Output != d.Reducer.Type {
+			v.report("mapper.output", "must be reducer.type unless there's a reducer.lift, got %s", d.Mapper.Output)
+		}
+	case ModeHistogram:
+		if d.Histogram.Bins < 1 {
+			v.report("histogram.bins", "must be at least 1, got %d", d.Histogram.Bins)
+		}
+	case ModeMap:
+		// Without a reducer, mapper outputs are written back directly
+		v.required("mapper.output", d.Mapper.Output)
+		v.typeWidth("mapper.outputWidth", d.Mapper.OutputWidth)
+		v.required("mapper.serialize", d.Mapper.Serialize)
+	}
+
+	return v.problems
+}
+
+// Go identifiers, as input names become fields and Top arguments
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (d Data) validateInputs(v *validator) {
+	names := map[string]bool{}
+	for i, input := range d.Inputs {
+		field := fmt.Sprintf("inputs[%d]", i)
+		if input.Name == "" {
+			v.report(field+".name", "is required")
+		} else if !identifier.MatchString(input.Name) {
+			v.report(field+".name", "must be a Go identifier, got %q", input.Name)
+		} else if names[input.Name] {
+			v.report(field+".name", "%s is used by another input", input.Name)
+		}
+		names[input.Name] = true
+
+		v.required(field+".type", input.Type)
+		v.typeWidth(field+".typeWidth", input.TypeWidth)
+		v.required(field+".deserialize", input.Deserialize)
+	}
+}
+
+func (d Data) validateParams(v *validator) {
+	names := map[string]bool{}
+	for i, param := range d.Params {
+		field := fmt.Sprintf("params[%d]", i)
+		if param.Name == "" {
+			v.report(field+".name", "is required")
+		} else if !identifier.MatchString(param.Name) {
+			v.report(field+".name", "must be a Go identifier, got %q", param.Name)
+		} else if names[param.Name] {
+			v.report(field+".name", "%s is used by another param", param.Name)
+		}
+		names[param.Name] = true
+
+		v.required(field+".type", param.Type)
+	}
+}
+
+func (d Data) validateTables(v *validator) {
+	names := map[string]bool{}
+	for i, table := range d.Tables {
+		field := fmt.Sprintf("tables[%d]", i)
+		if table.Name == "" {
+			v.report(field+".name", "is required")
+		} else if !identifier.MatchString(table.Name) {
+			v.report(field+".name", "must be a Go identifier, got %q", table.Name)
+		} else if names[table.Name] {
+			v.report(field+".name", "%s is used by another table", table.Name)
+		}
+		names[table.Name] = true
+
+		v.required(field+".type", table.Type)
+		v.typeWidth(field+".typeWidth", table.TypeWidth)
+		if table.Size < 1 {
+			v.report(field+".size", "must be at least 1, got %d", table.Size)
+		}
+	}
+}
+
+func (s Source) validate(v *validator, zipped bool) {
+	if zipped {
+		v.report("source", "can't be used along with inputs")
+	}
+	if s.Function != "" && s.Broadcast {
+		v.report("source.broadcast", "can't be used along with source.function")
+	}
+	if s.Function == "" && !s.Broadcast {
+		v.report("source", "needs a function, or broadcast set to true")
+	}
+}
+
+func (c Context) validate(v *validator) {
+	v.required("context.output", c.Output)
+	v.required("context.function", c.Function)
+
+	v.typeWidth("context.inputWidth", c.InputWidth)
+	if c.Input == "" {
+		if c.InputWidth != 0 {
+			v.report("context.inputWidth", "isn't used without context.input")
+		}
+		if c.Deserialize != "" {
+			v.report("context.deserialize", "isn't used without context.input")
+		}
+	}
+}
+
+func (m Mapper) validate(v *validator, zipped bool, generated bool) {
+	// Zipped inputs each describe their own elements
+	if zipped {
+		unused := func(field string, given bool) {
+			if given {
+				v.report(field, "can't be used along with inputs")
+			}
+		}
+		unused("mapper.type", m.Type != "")
+		unused("mapper.typeWidth", m.TypeWidth != 0)
+		unused("mapper.deserialize", m.Deserialize != "")
+		unused("mapper.window", m.Window != nil)
+	} else {
+		v.required("mapper.type", m.Type)
+		v.typeWidth("mapper.typeWidth", m.TypeWidth)
+		// Generated elements are never read from memory
+		if !generated {
+			v.required("mapper.deserialize", m.Deserialize)
+		} else if m.Deserialize != "" {
+			v.report("mapper.deserialize", "isn't used with source.function")
+		}
+	}
+	v.required("mapper.function", m.Function)
+
+	if m.Replicate < 1 {
+		v.report("mapper.replicate", "must be at least 1, got %d", m.Replicate)
+	}
+
+	if m.Window != nil {
+		if m.Window.Size < 1 {
+			v.report("mapper.window.size", "must be at least 1, got %d", m.Window.Size)
+		}
+		if m.Window.Stride < 0 {
+			v.report("mapper.window.stride", "must be at least 1, got %d", m.Window.Stride)
+		}
+	}
+}
+
+func (r Reducer) validate(v *validator, replicate int) {
+	v.required("reducer.type", r.Type)
+	v.typeWidth("reducer.typeWidth", r.TypeWidth)
+	v.required("reducer.serialize", r.Serialize)
+	v.required("reducer.function", r.Function)
+	v.required("reducer.empty", r.Empty)
+
+	if r.Arity != 0 && r.Arity < 2 {
+		v.report("reducer.arity", "must be at least 2, got %d", r.Arity)
+	}
+
+	if r.Keys < 0 {
+		v.report("reducer.keys", "must be at least 1, got %d", r.Keys)
+	}
+	// Keyed reduction accumulates into a table rather than through a tree
+	if r.Keys != 0 {
+		if r.Depth != 0 {
+			v.report("reducer.depth", "isn't used with reducer.keys")
+		}
+		if r.Scan != "" {
+			v.report("reducer.scan", "can't be used along with reducer.keys")
+		}
+		return
+	}
+
+	// Scans use their own network rather than the tree
+	if r.Scan != "" {
+		if r.Scan != ScanInclusive && r.Scan != ScanExclusive {
+			v.report("reducer.scan", "must be %s or %s, got %s", ScanInclusive, ScanExclusive, r.Scan)
+		}
+		if r.Depth != 0 {
+			v.report("reducer.depth", "isn't used with reducer.scan")
+		}
+		if r.Nary() {
+			v.report("reducer.arity", "must be 2 with reducer.scan")
+		}
+		return
+	}
+
+	// Without a valid replicate and arity there's no meaningful depth to
+	// check against
+	if replicate < 1 || r.Fanin() < 2 {
+		return
+	}
+
+	// Shallower trees are allowed, leaving more for the final accumulator
+	// to fold
+	if max := logk(r.Fanin(), replicate); r.Depth < 0 || r.Depth > max {
+		v.report("reducer.depth", "must be between 0 and %d, the depth of a full tree over mapper.replicate, got %d", max, r.Depth)
+	}
+}
+
+func (d Data) validatePipeline(v *validator) {
+	if d.Context != nil {
+		v.report("context", "can't be used along with stages")
+	}
+	if d.Mapper != (Mapper{}) {
+		v.report("mapper", "can't be used along with stages, use a map stage instead")
+	}
+	if d.Reducer != nil {
+		v.report("reducer", "can't be used along with stages, use a reduce stage instead")
+	}
+	if d.Histogram != nil {
+		v.report("histogram", "can't be used along with stages")
+	}
+	if len(d.Inputs) != 0 {
+		v.report("inputs", "can't be used along with stages")
+	}
+	if len(d.Params) != 0 {
+		v.report("params", "can't be used along with stages")
+	}
+	if len(d.Tables) != 0 {
+		v.report("tables", "can't be used along with stages")
+	}
+	if d.Source != nil {
+		v.report("source", "can't be used along with stages")
+	}
+
+	last := len(d.Stages) - 1
+	for i, stage := range d.Stages {
+		stage.validate(v, fmt.Sprintf("stages[%d]", i), i == 0, i == last)
+	}
+}
+
+func (s Stage) validate(v *validator, field string, first bool, last bool) {
+	// Only settings that make sense for the kind of stage may be given
+	unused := func(name string, given bool) {
+		if given {
+			v.report(field+"."+name, "isn't used by a %s stage", s.Kind)
+		}
+	}
+
+	v.required(field+".function", s.Function)
+	switch s.Kind {
+	case StageMap:
+		v.required(field+".output", s.Output)
+		if s.Replicate < 1 {
+			v.report(field+".replicate", "must be at least 1, got %d", s.Replicate)
+		}
+		unused("empty", s.Empty != "")
+		unused("scan", s.Scan != "")
+	case StageFilter:
+		unused("output", s.Output != "")
+		unused("replicate", s.Replicate != 0)
+		unused("empty", s.Empty != "")
+		unused("scan", s.Scan != "")
+	case StageReduce, StageScan:
+		v.required(field+".empty", s.Empty)
+		unused("output", s.Output != "")
+		unused("replicate", s.Replicate != 0)
+		if s.Kind == StageReduce {
+			unused("scan", s.Scan != "")
+		} else if s.Scan != "" && s.Scan != ScanInclusive && s.Scan != ScanExclusive {
+			v.report(field+".scan", "must be %s or %s, got %s", ScanInclusive, ScanExclusive, s.Scan)
+		}
+	default:
+		v.report(field+".kind", "must be %s, %s, %s or %s, got %q", StageMap, StageFilter, StageReduce, StageScan, s.Kind)
+	}
+
+	// The first stage reads the input, and the last writes the output
+	if first {
+		v.required(field+".type", s.Type)
+		v.typeWidth(field+".typeWidth", s.TypeWidth)
+		v.required(field+".deserialize", s.Deserialize)
+	} else {
+		if s.TypeWidth != 0 {
+			v.report(field+".typeWidth", "is only used by the first stage")
+		}
+		if s.Deserialize != "" {
+			v.report(field+".deserialize", "is only used by the first stage")
+		}
+	}
+	if last {
+		v.typeWidth(field+".outputWidth", s.OutputWidth)
+		v.required(field+".serialize", s.Serialize)
+	} else {
+		if s.OutputWidth != 0 {
+			v.report(field+".outputWidth", "is only used by the last stage")
+		}
+		if s.Serialize != "" {
+			v.report(field+".serialize", "is only used by the last stage")
+		}
+	}
+}
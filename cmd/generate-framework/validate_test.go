@@ -0,0 +1,207 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateReducer(t *testing.T) {
+	tests := []struct {
+		reducer Reducer
+		want    []string
+	}{
+		{Reducer{Arity: 1, Keys: -3, Depth: 1}, []string{"reducer.arity", "reducer.keys", "reducer.depth"}},
+		{Reducer{Arity: 1, Depth: 9}, []string{"reducer.arity"}},
+		{Reducer{Arity: 3, Depth: 9}, []string{"reducer.depth"}},
+		{Reducer{Arity: 1, Scan: "sideways"}, []string{"reducer.arity", "reducer.scan"}},
+	}
+
+	for _, test := range tests {
+		test.reducer.Type = "uint32"
+		test.reducer.Serialize = Auto
+		test.reducer.Function = "Add"
+		test.reducer.Empty = "Zero"
+
+		v := &validator{positions: Positions{}}
+		test.reducer.validate(v, 4)
+
+		got := []string{}
+		for _, problem := range v.problems {
+			got = append(got, problem.Field)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: problems with %v, want %v", test.reducer, got, test.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"valid", `
+mapper:
+  type: uint32
+  deserialize: auto
+  function: F
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+  depth: 2
+`, nil},
+		{"histogram with a reducer", `
+mapper:
+  type: uint32
+  deserialize: auto
+  function: F
+  replicate: 4
+  localFold: true
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+histogram:
+  bins: 0
+`, []string{
+			"13:1: histogram: can't be used along with a reducer",
+			"7:14: mapper.localFold: needs a reducer, without keys or scan",
+			"14:9: histogram.bins: must be at least 1, got 0",
+		}},
+		{"flat keyed reduce", `
+mapper:
+  type: uint32
+  deserialize: auto
+  function: F
+  flatMap: true
+  output: uint64
+  replicate: 4
+reducer:
+  type: uint32
+  serialize: auto
+  function: Add
+  empty: Zero
+  keys: 8
+  depth: 1
+`, []string{
+			"6:12: mapper.flatMap: can't be used with keyed reduce or scan",
+			"15:10: reducer.depth: isn't used with reducer.keys",
+			"7:11: mapper.output: must be reducer.type unless there's a reducer.lift, got uint64",
+		}},
+		{"map without outputs", `
+mapper:
+  type: uint32
+  deserialize: auto
+  function: F
+  replicate: 0
+  outputWidth: 33
+`, []string{
+			"6:14: mapper.replicate: must be at least 1, got 0",
+			"2:1: mapper.output: is required",
+			"7:16: mapper.outputWidth: must be a positive multiple of 32, got 33",
+			"2:1: mapper.serialize: is required",
+		}},
+		{"zip with mapper elements", `
+inputs:
+  - name: xs
+    type: uint32
+    deserialize: auto
+  - name: xs
+    type: uint32
+mapper:
+  type: uint32
+  deserialize: auto
+  function: F
+  window:
+    size: 2
+  replicate: 4
+  output: uint32
+  serialize: auto
+source:
+  broadcast: true
+`, []string{
+			"9:9: mapper.type: can't be used along with inputs",
+			"10:16: mapper.deserialize: can't be used along with inputs",
+			"12:3: mapper.window: can't be used along with inputs",
+			"6:11: inputs[1].name: xs is used by another input",
+			"6:3: inputs[1].deserialize: is required",
+			"17:1: source: can't be used along with inputs",
+		}},
+		{"source", `
+source:
+  function: Gen
+  broadcast: true
+mapper:
+  type: uint32
+  deserialize: auto
+  function: F
+  window:
+    size: 0
+    stride: -1
+  replicate: 4
+  output: uint32
+  serialize: auto
+`, []string{
+			"7:16: mapper.deserialize: isn't used with source.function",
+			"10:11: mapper.window.size: must be at least 1, got 0",
+			"11:13: mapper.window.stride: must be at least 1, got -1",
+			"4:14: source.broadcast: can't be used along with source.function",
+		}},
+		{"pipeline", `
+mapper:
+  replicate: 4
+source:
+  broadcast: true
+stages:
+  - kind: filter
+    type: uint32
+    function: Keep
+    replicate: 2
+    serialize: auto
+  - kind: fold
+    function: Add
+    deserialize: auto
+  - kind: scan
+    function: Add
+    empty: Zero
+    scan: sideways
+`, []string{
+			"2:1: mapper: can't be used along with stages, use a map stage instead",
+			"4:1: source: can't be used along with stages",
+			"10:16: stages[0].replicate: isn't used by a filter stage",
+			"7:3: stages[0].deserialize: is required",
+			"11:16: stages[0].serialize: is only used by the last stage",
+			"12:11: stages[1].kind: must be map, filter, reduce or scan, got \"fold\"",
+			"14:18: stages[1].deserialize: is only used by the first stage",
+			"18:11: stages[2].scan: must be inclusive or exclusive, got sideways",
+			"15:3: stages[2].serialize: is required",
+		}},
+	}
+
+	for _, test := range tests {
+		_, _, problems, err := readConfig([]byte(test.config))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		got := []string{}
+		for _, problem := range problems {
+			got = append(got, problem.Error())
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got problems\n\t%s\nwant\n\t%s", test.name, strings.Join(got, "\n\t"), strings.Join(test.want, "\n\t"))
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got problem %s, want %s", test.name, got[i], test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"go/types"
+)
+
+// Width is the number of bits a value of t occupies when sent through
+// memory. Every scalar is padded out to whole 32 bit words, so fields are
+// never split across, or packed within, a word. Structs are the sum of
+// their fields in order, and arrays the width of their element times
+// their length.
+func Width(t types.Type) (int, error) {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch u.Kind() {
+		case types.Bool, types.Int8, types.Int16, types.Int32, types.Uint8, types.Uint16, types.Uint32:
+			return 32, nil
+		case types.Int64, types.Uint64:
+			return 64, nil
+		}
+	case *types.Array:
+		elem, err := Width(u.Elem())
+		if err != nil {
+			return 0, err
+		}
+		return elem * int(u.Len()), nil
+	case *types.Struct:
+		width := 0
+		for i := 0; i < u.NumFields(); i++ {
+			field, err := Width(u.Field(i).Type())
+			if err != nil {
+				return 0, fmt.Errorf("field %s: %s", u.Field(i).Name(), err)
+			}
+			width += field
+		}
+		return width, nil
+	}
+	return 0, fmt.Errorf("%s has no fixed width in memory", t)
+}
+
+// TypeWidth infers the width of t when the config doesn't give one, and
+// otherwise reports if the given width disagrees with t.
+func (c *typeChecker) TypeWidth(field string, t types.Type, given int) int {
+	if t == nil {
+		return given
+	}
+
+	width, err := Width(t)
+	if err != nil {
+		if given == 0 {
+			c.report(field, "can't be inferred, %s", err)
+		}
+		return given
+	}
+
+	if given != 0 && given != width {
+		c.report(field, "is %d, but %s is %d bits wide", given, types.TypeString(t, c.pkg.qualifier), width)
+	}
+	return width
+}